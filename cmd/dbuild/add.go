@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A contextAdd adds a file or directory from outside the root to the build
+// context.
+type contextAdd struct {
+	// The file or directory to add, and where to put it in the context.
+	Source string
+	Dest   string
+}
+
+// Parses a "<source>:<destination>" argument to --add.
+func parseAdd(arg string) (contextAdd, error) {
+	idx := strings.LastIndex(arg, ":")
+	if idx <= 0 {
+		return contextAdd{}, fmt.Errorf("Invalid --add %q: expected <source>:<destination>", arg)
+	}
+
+	source, err := filepath.Abs(arg[:idx])
+	if err != nil {
+		return contextAdd{}, fmt.Errorf("Error finding absolute path: %s", err)
+	}
+
+	// Cleaning the destination as an absolute path keeps it in the context.
+	dest := path.Clean("/" + filepath.ToSlash(arg[idx+1:]))[1:]
+	if len(dest) == 0 {
+		return contextAdd{}, fmt.Errorf("Invalid --add %q: the destination must be a path in the build context", arg)
+	}
+
+	return contextAdd{Source: source, Dest: dest}, nil
+}
+
+// An addedFile is a single file, directory or symlink added to the context by
+// a contextAdd.
+type addedFile struct {
+	path string
+	name string
+	info os.FileInfo
+	from contextAdd
+
+	// Set for the directories that a destination is in, which only exist
+	// in the context if they're not in the root.
+	implicit bool
+}
+
+// The FileInfo for a directory that's only implied by an added file's
+// destination.
+type implicitDir struct {
+	name    string
+	modTime time.Time
+}
+
+func (d implicitDir) Name() string       { return d.name }
+func (d implicitDir) Size() int64        { return 0 }
+func (d implicitDir) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d implicitDir) ModTime() time.Time { return d.modTime }
+func (d implicitDir) IsDir() bool        { return true }
+func (d implicitDir) Sys() interface{}   { return nil }
+
+// Finds every file that the given adds put into the context, by their names
+// in it.  Directories are added along with everything under them.
+func collectAdds(adds []contextAdd) (map[string]*addedFile, error) {
+	ret := make(map[string]*addedFile)
+
+	put := func(f *addedFile) error {
+		if f.name == "Dockerfile" {
+			return fmt.Errorf("--add %s:%s would replace the Dockerfile", f.from.Source, f.from.Dest)
+		}
+
+		// Directories can be merged, but nothing else can.  A directory
+		// that's really added takes the place of an implicit one.
+		other, ok := ret[f.name]
+		if ok && !(other.info.IsDir() && f.info.IsDir()) {
+			return fmt.Errorf("--add %s and --add %s both add %s",
+				other.from.Source, f.from.Source, f.name)
+		}
+		if !ok || other.implicit {
+			ret[f.name] = f
+		}
+		return nil
+	}
+
+	for _, a := range adds {
+		// Like the Dockerfile, a symlinked source is followed.
+		info, err := os.Stat(a.Source)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading --add source: %s", err)
+		}
+		if err = put(&addedFile{a.Source, a.Dest, info, a, false}); err != nil {
+			return nil, err
+		}
+
+		// The directories that the destination is in are added too, so
+		// that they're checked against the root.
+		for dir := path.Dir(a.Dest); dir != "."; dir = path.Dir(dir) {
+			parent := implicitDir{path.Base(dir), info.ModTime()}
+			if err = put(&addedFile{"", dir, parent, a, true}); err != nil {
+				return nil, err
+			}
+		}
+		if !info.IsDir() {
+			continue
+		}
+
+		root, err := filepath.EvalSymlinks(a.Source)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading --add source: %s", err)
+		}
+		err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			return put(&addedFile{p, path.Join(a.Dest, filepath.ToSlash(rel)), info, a, false})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error adding %s: %s", a.Source, err)
+		}
+	}
+
+	return ret, nil
+}
+
+// Returns the added files, sorted by name, so that directories come before
+// what's in them.
+func sortedAdds(added map[string]*addedFile) []*addedFile {
+	ret := make([]*addedFile, 0, len(added))
+	for _, f := range added {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+	return ret
+}
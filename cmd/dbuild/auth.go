@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// The registry that images without a registry host are pushed to.
+const defaultRegistry = "index.docker.io"
+
+// An entry in a Docker config file.
+type dockerAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// Returns the path to the user's Docker credentials: either the newer
+// ~/.docker/config.json (or $DOCKER_CONFIG/config.json), or the older
+// ~/.dockercfg.  An empty path means there aren't any.
+func dockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if len(dir) == 0 {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	for _, path := range []string{
+		filepath.Join(dir, "config.json"),
+		filepath.Join(os.Getenv("HOME"), ".dockercfg"),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Reads registry credentials from a Docker config file, keyed by the host
+// name of the registry.  Both the config.json and .dockercfg formats are
+// supported.
+func readDockerAuth(path string) (map[string]docker.AuthConfiguration, error) {
+	ret := make(map[string]docker.AuthConfiguration)
+	if len(path) == 0 {
+		return ret, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// config.json nests the entries under "auths"; .dockercfg doesn't.
+	var config struct {
+		Auths map[string]dockerAuth `json:"auths"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	entries := config.Auths
+	if entries == nil {
+		if err = json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+	}
+
+	for key, entry := range entries {
+		auth := docker.AuthConfiguration{
+			Username: entry.Username,
+			Password: entry.Password,
+			Email:    entry.Email,
+		}
+
+		if len(entry.Auth) > 0 {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid credentials for %s in %s: %s", key, path, err)
+			}
+
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Invalid credentials for %s in %s", key, path)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+
+		ret[registryHost(key)] = auth
+	}
+
+	return ret, nil
+}
+
+// Normalizes a registry from a Docker config file, which may be a URL such
+// as "https://index.docker.io/v1/", into a host name.
+func registryHost(key string) string {
+	if idx := strings.Index(key, "://"); idx >= 0 {
+		key = key[idx+3:]
+	}
+	if idx := strings.IndexByte(key, '/'); idx >= 0 {
+		key = key[:idx]
+	}
+	if key == "docker.io" || key == "registry-1.docker.io" {
+		key = defaultRegistry
+	}
+	return key
+}
+
+// Returns the host name of the registry that the given repository is pushed
+// to.
+func repositoryRegistry(repo string) string {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return registryHost(parts[0])
+	}
+	return defaultRegistry
+}
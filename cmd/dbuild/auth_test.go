@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDockerAuth(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dbuild-auth")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "dXNlcjpzZWNyZXQ=" is "user:secret", and "Ym90OnBhc3M=" is "bot:pass".
+	configJSON := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(configJSON, []byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "dXNlcjpzZWNyZXQ=", "email": "me@example.com"},
+			"registry.example.com:5000": {"auth": "Ym90OnBhc3M="}
+		}
+	}`), 0600)
+
+	auths, err := readDockerAuth(configJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, auths, map[string]docker.AuthConfiguration{
+		"index.docker.io":           {Username: "user", Password: "secret", Email: "me@example.com"},
+		"registry.example.com:5000": {Username: "bot", Password: "pass"},
+	})
+
+	dockercfg := filepath.Join(dir, ".dockercfg")
+	ioutil.WriteFile(dockercfg, []byte(`{
+		"https://index.docker.io/v1/": {"auth": "dXNlcjpzZWNyZXQ=", "email": "me@example.com"}
+	}`), 0600)
+
+	auths, err = readDockerAuth(dockercfg)
+	assert.NoError(t, err)
+	assert.Equal(t, auths, map[string]docker.AuthConfiguration{
+		"index.docker.io": {Username: "user", Password: "secret", Email: "me@example.com"},
+	})
+
+	// No config file means no credentials.
+	auths, err = readDockerAuth("")
+	assert.NoError(t, err)
+	assert.Equal(t, len(auths), 0)
+
+	bad := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(bad, []byte(`{"auths": {"example.com": {"auth": "bm9jb2xvbg=="}}}`), 0600)
+	_, err = readDockerAuth(bad)
+	assert.EqualError(t, err, "Invalid credentials for example.com in "+bad)
+}
+
+func TestRepositoryRegistry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Repo     string
+		Expected string
+	}{
+		{"busybox", "index.docker.io"},
+		{"andrew-d/app", "index.docker.io"},
+		{"docker.io/andrew-d/app", "index.docker.io"},
+		{"registry.example.com/app", "registry.example.com"},
+		{"localhost:5000/app", "localhost:5000"},
+		{"localhost/app", "localhost"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, repositoryRegistry(test.Repo), test.Expected, test.Repo)
+	}
+}
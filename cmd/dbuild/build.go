@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// The version of go-dockerclient that we use decodes the JSON build stream
+// itself, and ignores some errors in it, so we make the request ourselves.
+func buildImage(conn *dockerconn.Conn, opts docker.BuildImageOptions, r *buildReporter) error {
+	query := url.Values{}
+	query.Set("t", opts.Name)
+	if opts.NoCache {
+		query.Set("nocache", "1")
+	}
+	if opts.RmTmpContainer {
+		query.Set("rm", "1")
+	}
+	if opts.ForceRmTmpContainer {
+		query.Set("forcerm", "1")
+	}
+
+	resp, err := conn.HTTPClient.Post(conn.URL("/build?"+query.Encode()), "application/tar", opts.InputStream)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("API error (%d): %s", resp.StatusCode, body)
+	}
+
+	isJSON := resp.Header.Get("Content-Type") == "application/json"
+	return r.Consume(resp.Body, isJSON)
+}
+
+// A buildMessage is a single message from Docker's JSON build stream.
+type buildMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	Progress    string `json:"progress"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// A buildStep records how long one step of the Dockerfile took.
+type buildStep struct {
+	Number   string
+	Command  string
+	Cached   bool
+	Duration time.Duration
+}
+
+var (
+	stepRegex  = regexp.MustCompile(`^Step (\d+)(?:/\d+)? ?: (.*)$`)
+	cacheRegex = regexp.MustCompile(`^ ---> Using cache$`)
+)
+
+// A buildReporter renders the output of a build, and keeps track of the time
+// each step took.
+type buildReporter struct {
+	out io.Writer
+
+	// If set, receives a copy of the build's output.
+	log io.Writer
+
+	// Overridden in tests.
+	now func() time.Time
+
+	steps     []*buildStep
+	stepStart time.Time
+	partial   string
+}
+
+func newBuildReporter(out, log io.Writer) *buildReporter {
+	return &buildReporter{
+		out: out,
+		log: log,
+		now: time.Now,
+	}
+}
+
+// Consume reads a build's output until it finishes, returning an error if the
+// build failed.  The output is either a stream of JSON messages, or, from
+// older daemons, plain text.
+func (r *buildReporter) Consume(body io.Reader, isJSON bool) error {
+	defer r.endStep()
+
+	if !isJSON {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			r.write(scanner.Text() + "\n")
+		}
+		return scanner.Err()
+	}
+
+	dec := json.NewDecoder(body)
+	for {
+		var m buildMessage
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading build output: %s", err)
+		}
+
+		if m.ErrorDetail != nil && len(m.ErrorDetail.Message) > 0 {
+			m.Error = m.ErrorDetail.Message
+		}
+		if len(m.Error) > 0 {
+			r.flush()
+			r.write(m.Error + "\n")
+			return fmt.Errorf("%s", strings.TrimSpace(m.Error))
+		}
+
+		if len(m.Stream) > 0 {
+			r.write(m.Stream)
+		}
+		if len(m.Status) > 0 {
+			r.write(strings.TrimSpace(m.Status+" "+m.Progress) + "\n")
+		}
+	}
+
+	r.flush()
+	return nil
+}
+
+// Writes build output, and tracks steps from each complete line of it.
+func (r *buildReporter) write(s string) {
+	io.WriteString(r.out, s)
+	if r.log != nil {
+		io.WriteString(r.log, s)
+	}
+
+	s = r.partial + s
+	for {
+		idx := strings.IndexByte(s, '\n')
+		if idx < 0 {
+			break
+		}
+		r.handleLine(strings.TrimRight(s[:idx], "\r"))
+		s = s[idx+1:]
+	}
+	r.partial = s
+}
+
+// Handles any trailing output without a newline.
+func (r *buildReporter) flush() {
+	if len(r.partial) > 0 {
+		r.write("\n")
+	}
+}
+
+func (r *buildReporter) handleLine(line string) {
+	if m := stepRegex.FindStringSubmatch(line); m != nil {
+		r.endStep()
+		r.steps = append(r.steps, &buildStep{Number: m[1], Command: m[2]})
+		r.stepStart = r.now()
+		return
+	}
+
+	if cacheRegex.MatchString(line) && len(r.steps) > 0 {
+		r.steps[len(r.steps)-1].Cached = true
+	}
+}
+
+// Records the duration of the current step, if there is one.
+func (r *buildReporter) endStep() {
+	if len(r.steps) == 0 || r.stepStart.IsZero() {
+		return
+	}
+	r.steps[len(r.steps)-1].Duration = r.now().Sub(r.stepStart)
+	r.stepStart = time.Time{}
+}
+
+// Summary prints how long each step of the build took.
+func (r *buildReporter) Summary(out io.Writer) {
+	if len(r.steps) == 0 {
+		return
+	}
+
+	var total time.Duration
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tTIME\tCOMMAND")
+	for _, step := range r.steps {
+		command := step.Command
+		if step.Cached {
+			command += " (cached)"
+		}
+		fmt.Fprintf(w, "%s\t%.1fs\t%s\n", step.Number, step.Duration.Seconds(), command)
+		total += step.Duration
+	}
+	fmt.Fprintf(w, "\t%.1fs\ttotal\n", total.Seconds())
+	w.Flush()
+}
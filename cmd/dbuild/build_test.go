@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a reporter whose clock advances by a second every time it's read.
+func newTestReporter(out, log io.Writer) *buildReporter {
+	r := newBuildReporter(out, log)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return r
+}
+
+const testBuildStream = `{"stream":"Step 1/3 : FROM busybox\n"}
+{"stream":" ---> 4986bf8c1536\n"}
+{"stream":"Step 2/3 : RUN echo "}
+{"stream":"hello\n"}
+{"stream":" ---> Using cache\n"}
+{"stream":" ---> 1a2b3c4d5e6f\n"}
+{"stream":"Step 3/3 : RUN false\n"}
+{"status":"Downloading","progress":"[==>  ] 1 MB"}
+`
+
+func TestBuildReporter(t *testing.T) {
+	t.Parallel()
+
+	var out, log bytes.Buffer
+	r := newTestReporter(&out, &log)
+
+	body := testBuildStream + `{"stream":"Successfully built 1a2b3c4d5e6f\n"}`
+	err := r.Consume(strings.NewReader(body), true)
+	assert.NoError(t, err)
+	assert.Equal(t, out.String(), ""+
+		"Step 1/3 : FROM busybox\n"+
+		" ---> 4986bf8c1536\n"+
+		"Step 2/3 : RUN echo hello\n"+
+		" ---> Using cache\n"+
+		" ---> 1a2b3c4d5e6f\n"+
+		"Step 3/3 : RUN false\n"+
+		"Downloading [==>  ] 1 MB\n"+
+		"Successfully built 1a2b3c4d5e6f\n")
+	assert.Equal(t, log.String(), out.String())
+
+	var summary bytes.Buffer
+	r.Summary(&summary)
+	assert.Equal(t, summary.String(), ""+
+		"STEP  TIME  COMMAND\n"+
+		"1     1.0s  FROM busybox\n"+
+		"2     1.0s  RUN echo hello (cached)\n"+
+		"3     1.0s  RUN false\n"+
+		"      3.0s  total\n")
+}
+
+func TestBuildReporterError(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	r := newTestReporter(&out, nil)
+
+	body := testBuildStream + `{"errorDetail":{"code":1,"message":"The command '/bin/sh -c false' returned a non-zero code: 1"},"error":"The command '/bin/sh -c false' returned a non-zero code: 1"}
+{"stream":"never seen\n"}`
+	err := r.Consume(strings.NewReader(body), true)
+	assert.EqualError(t, err, "The command '/bin/sh -c false' returned a non-zero code: 1")
+	assert.NotContains(t, out.String(), "never seen")
+	assert.Equal(t, len(r.steps), 3)
+	assert.Equal(t, r.steps[2].Duration, time.Second)
+
+	// Bad JSON is an error too.
+	r = newTestReporter(&out, nil)
+	err = r.Consume(strings.NewReader(`{"stream":`), true)
+	assert.EqualError(t, err, "Error reading build output: unexpected EOF")
+}
+
+func TestBuildImage(t *testing.T) {
+	t.Parallel()
+
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	defer server.Stop()
+
+	var ctx bytes.Buffer
+	tw := tar.NewWriter(&ctx)
+	tw.WriteHeader(&tar.Header{Name: "Dockerfile", Size: 12, Mode: 0644})
+	tw.Write([]byte("FROM busybox"))
+	tw.Close()
+
+	// The fake server replies with plain text.
+	var out bytes.Buffer
+	err = buildImage(newTestConn(t, server.URL()), docker.BuildImageOptions{
+		Name:        "myapp",
+		InputStream: bytes.NewReader(ctx.Bytes()),
+	}, newTestReporter(&out, nil))
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Successfully built ")
+
+	// Errors in the JSON stream fail the build, even though the request
+	// itself succeeded.
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Query().Get("t"), "myapp")
+		assert.Equal(t, r.URL.Query().Get("nocache"), "1")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"stream":"Step 1 : FROM nothere\n"}` + "\n"))
+		w.Write([]byte(`{"errorDetail":{"message":"image not found"},"error":"image not found"}` + "\n"))
+	}))
+	err = buildImage(newTestConn(t, server.URL()), docker.BuildImageOptions{
+		Name:        "myapp",
+		NoCache:     true,
+		InputStream: bytes.NewReader(ctx.Bytes()),
+	}, newTestReporter(&out, nil))
+	assert.EqualError(t, err, "image not found")
+
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "server error", http.StatusInternalServerError)
+	}))
+	err = buildImage(newTestConn(t, server.URL()), docker.BuildImageOptions{
+		Name:        "myapp",
+		InputStream: bytes.NewReader(ctx.Bytes()),
+	}, newTestReporter(&out, nil))
+	assert.EqualError(t, err, "API error (500): server error\n")
+}
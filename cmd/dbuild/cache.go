@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A buildRecord is saved after an image is exported, recording what it was
+// built from, so that the next build can be skipped if nothing's changed.
+type buildRecord struct {
+	Inputs       string `json:"inputs"`
+	OutputSize   int64  `json:"output_size"`
+	OutputSHA256 string `json:"output_sha256"`
+
+	// The tags that couldn't be tagged or pushed, which mean the next build
+	// can't be skipped.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// Hashes everything that goes into the exported image: the Dockerfile, the
+// names, modes, link targets and contents of every file in the context, and
+// the options that change the output file, or what's done with the image.  A
+// generated name is different every time, so it isn't hashed.
+func (b *imageBuild) inputsHash() (string, error) {
+	h := sha256.New()
+	name := b.Name
+	if b.GeneratedName {
+		name = "<generated>"
+	}
+	fmt.Fprintf(h, "name=%s\ncompression=%s\nlevel=%d\nsquash=%t\nnocache=%t\n",
+		name, b.Compression, b.CompressLevel, b.Squash, b.NoCache)
+	fmt.Fprintf(h, "tags=%s\npush=%t\n", strings.Join(b.Tags, ","), b.Push)
+	if b.SignKey != nil {
+		fmt.Fprintf(h, "signer=%x\n", b.SignKey.Public())
+	}
+
+	opts := *b.Context
+	opts.Progress = nil
+
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := writeContext(pw, &opts)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+
+	err := hashContext(h, pr)
+	pr.Close()
+	if werr := <-errc; werr != nil {
+		return "", werr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hashes each entry in a context, leaving out its owner and times, which
+// change with every checkout without changing what's built.
+func hashContext(h io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "%q %c %o %d %q\n", hdr.Name, hdr.Typeflag, hdr.Mode&07777, hdr.Size, hdr.Linkname)
+		if _, err = io.Copy(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns where the build record for an output file is kept: either next to
+// it, or in the cache directory, if one is given.
+func buildRecordPath(outputPath, cacheDir string) (string, error) {
+	abs, err := filepath.Abs(outputPath)
+	if err != nil {
+		return "", err
+	}
+
+	if len(cacheDir) == 0 {
+		return abs + ".dbuild", nil
+	}
+
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// Reads a build record.  If there isn't one, both the record and the error
+// are nil.
+func readBuildRecord(path string) (*buildRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ret := &buildRecord{}
+	if err = json.Unmarshal(data, ret); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	return ret, nil
+}
+
+func writeBuildRecord(path string, record *buildRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Returns whether the output file was built from the given inputs, and is
+// still exactly as it was when it was built.
+func (r *buildRecord) Matches(inputs, outputPath string) (bool, error) {
+	if r.Inputs != inputs {
+		return false, nil
+	}
+
+	f, err := os.Open(outputPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != r.OutputSize {
+		return false, nil
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == r.OutputSHA256, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/docker-tools/exitcode"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildRecordPath(t *testing.T) {
+	t.Parallel()
+
+	path, err := buildRecordPath("/out/image.tar", "")
+	assert.NoError(t, err)
+	assert.Equal(t, path, "/out/image.tar.dbuild")
+
+	path, err = buildRecordPath("/out/image.tar", "/cache")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Dir(path), "/cache")
+	assert.True(t, strings.HasSuffix(path, ".json"))
+
+	other, err := buildRecordPath("/out/other.tar", "/cache")
+	assert.NoError(t, err)
+	assert.NotEqual(t, path, other)
+}
+
+func TestBuildRecordMatches(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dbuild-cache")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// There's no record to start with.
+	recordPath := filepath.Join(dir, "cache", "record.json")
+	record, err := readBuildRecord(recordPath)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	outputPath := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(outputPath, []byte("image"), 0644); err != nil {
+		t.Fatalf("Error writing output file: %s", err)
+	}
+
+	err = writeBuildRecord(recordPath, &buildRecord{
+		Inputs:     "abc",
+		OutputSize: 5,
+		// SHA-256 of "image"
+		OutputSHA256: "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d",
+	})
+	assert.NoError(t, err)
+
+	record, err = readBuildRecord(recordPath)
+	if !assert.NoError(t, err) || !assert.NotNil(t, record) {
+		return
+	}
+
+	matches, err := record.Matches("abc", outputPath)
+	assert.NoError(t, err)
+	assert.True(t, matches)
+
+	matches, err = record.Matches("def", outputPath)
+	assert.NoError(t, err)
+	assert.False(t, matches)
+
+	// Same size, different contents.
+	ioutil.WriteFile(outputPath, []byte("imagf"), 0644)
+	matches, err = record.Matches("abc", outputPath)
+	assert.NoError(t, err)
+	assert.False(t, matches)
+
+	os.Remove(outputPath)
+	matches, err = record.Matches("abc", outputPath)
+	assert.NoError(t, err)
+	assert.False(t, matches)
+}
+
+func TestImageBuildSkipsUnchanged(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		builds int
+	)
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, func(r *http.Request) {
+		if r.URL.Path == "/build" {
+			mu.Lock()
+			builds++
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	defer server.Stop()
+
+	server.CustomHandler("/images/myapp/tag", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	conn := newTestConn(t, server.URL())
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+		"app.js":     "one",
+	})
+	defer os.RemoveAll(root)
+
+	countBuilds := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return builds
+	}
+	run := func(force bool, modify ...func(b *imageBuild)) *imageBuild {
+		// The output is under the root, but shouldn't count as an input.
+		b := &imageBuild{
+			Context: &contextOptions{
+				DockerfilePath: filepath.Join(root, "Dockerfile"),
+				RootPath:       root,
+			},
+			Name:       "myapp",
+			OutputPath: filepath.Join(root, "myapp.tar"),
+			Force:      force,
+		}
+		for _, f := range modify {
+			f(b)
+		}
+		assert.NoError(t, b.Run(conn))
+		return b
+	}
+
+	b := run(false)
+	assert.False(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 1)
+
+	b = run(false)
+	assert.True(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 1)
+
+	b = run(true)
+	assert.False(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 2)
+
+	// Changing a file in the context means a rebuild.
+	ioutil.WriteFile(filepath.Join(root, "app.js"), []byte("two"), 0644)
+	b = run(false)
+	assert.False(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 3)
+
+	// So does changing its mode.
+	os.Chmod(filepath.Join(root, "app.js"), 0755)
+	b = run(false)
+	assert.False(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 4)
+
+	// But not touching it, as a fresh checkout would.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(root, "app.js"), later, later)
+	os.Chtimes(root, later, later)
+	b = run(false)
+	assert.True(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 4)
+
+	// And adding a tag, since it wouldn't be tagged otherwise.
+	tag := func(b *imageBuild) { b.Tags = []string{"myapp:v2"} }
+	b = run(false, tag)
+	assert.False(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 5)
+	b = run(false, tag)
+	assert.True(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 5)
+
+	// A generated name is different every time, so it doesn't count.
+	generated := func(name string) func(b *imageBuild) {
+		return func(b *imageBuild) {
+			b.Name = name
+			b.GeneratedName = true
+		}
+	}
+	b = run(false, generated("abcdef"))
+	assert.False(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 6)
+	b = run(false, generated("ghijkl"))
+	assert.True(t, b.Unchanged)
+	assert.Equal(t, countBuilds(), 6)
+}
+
+func TestImageBuildPartialFailure(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		builds int
+	)
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, func(r *http.Request) {
+		if r.URL.Path == "/build" {
+			mu.Lock()
+			builds++
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	defer server.Stop()
+
+	server.CustomHandler("/images/myapp/tag", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no space left", http.StatusInternalServerError)
+	}))
+	conn := newTestConn(t, server.URL())
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+	})
+	defer os.RemoveAll(root)
+
+	run := func() *imageBuild {
+		b := &imageBuild{
+			Context: &contextOptions{
+				DockerfilePath: filepath.Join(root, "Dockerfile"),
+				RootPath:       root,
+			},
+			Name:       "myapp",
+			Tags:       []string{"myapp:v2"},
+			OutputPath: filepath.Join(root, "myapp.tar"),
+			Integrity:  true,
+		}
+		err := b.Run(conn)
+		assert.Equal(t, exitcode.Of(err), exitPartial)
+		return b
+	}
+
+	// The image was built, so its manifest is written, even though it
+	// couldn't be tagged.
+	b := run()
+	m, err := verifyImageFile(b.OutputPath, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, m.Name, "myapp")
+	}
+
+	// But the next build isn't skipped, so that tagging is retried.
+	b = run()
+	assert.False(t, b.Unchanged)
+	mu.Lock()
+	assert.Equal(t, builds, 2)
+	mu.Unlock()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// A compressionFormat describes one of the formats that the exported image
+// can be compressed with.
+type compressionFormat struct {
+	// File extensions that imply this format.
+	Extensions []string
+
+	// The range of valid compression levels.
+	MinLevel, MaxLevel int
+
+	// The external program used to compress, if any.
+	Program string
+}
+
+var compressionFormats = map[string]*compressionFormat{
+	"gzip": {
+		Extensions: []string{".gz", ".tgz"},
+		MinLevel:   1,
+		MaxLevel:   9,
+	},
+	"bzip2": {
+		Extensions: []string{".bz2", ".tbz2"},
+		MinLevel:   1,
+		MaxLevel:   9,
+		Program:    "bzip2",
+	},
+	"xz": {
+		Extensions: []string{".xz", ".txz"},
+		MinLevel:   1,
+		MaxLevel:   9,
+		Program:    "xz",
+	},
+	"zstd": {
+		Extensions: []string{".zst", ".zstd", ".tzst"},
+		MinLevel:   1,
+		MaxLevel:   19,
+		Program:    "zstd",
+	},
+}
+
+// Returns the compression format to use for the given output file.  If no
+// format is given, it's inferred from the file's extension; "none" disables
+// compression entirely.  An empty string means no compression.
+func compressionFor(format, outputPath string) (string, error) {
+	switch format {
+	case "none":
+		return "", nil
+
+	case "":
+		lower := strings.ToLower(outputPath)
+		for name, f := range compressionFormats {
+			for _, ext := range f.Extensions {
+				if strings.HasSuffix(lower, ext) {
+					return name, nil
+				}
+			}
+		}
+		return "", nil
+	}
+
+	if _, ok := compressionFormats[format]; !ok {
+		return "", fmt.Errorf("Unknown compression format %q (must be one of gzip, bzip2, xz, zstd or none)", format)
+	}
+	return format, nil
+}
+
+// Checks that we're able to compress with the given format and level.  A
+// level of 0 means the format's default level.
+func checkCompression(format string, level int) error {
+	if len(format) == 0 {
+		return nil
+	}
+
+	f := compressionFormats[format]
+	if level != 0 && (level < f.MinLevel || level > f.MaxLevel) {
+		return fmt.Errorf("Invalid %s compression level %d (must be between %d and %d)",
+			format, level, f.MinLevel, f.MaxLevel)
+	}
+
+	if len(f.Program) > 0 {
+		if _, err := exec.LookPath(f.Program); err != nil {
+			return fmt.Errorf("Compressing with %s requires the '%s' program: %s",
+				format, f.Program, err)
+		}
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Returns a writer that compresses everything written to it, and writes the
+// compressed data to the given writer.  The writer must be closed to flush
+// the compressed data.
+func newCompressWriter(w io.Writer, format string, level int) (io.WriteCloser, error) {
+	if len(format) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+
+	if format == "gzip" {
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	args := []string{"-c"}
+	if level != 0 {
+		args = append(args, fmt.Sprintf("-%d", level))
+	}
+	if format == "zstd" {
+		// zstd prints progress to stderr unless told not to.
+		args = append(args, "-q")
+	}
+
+	return startCmdWriter(w, compressionFormats[format].Program, args...)
+}
+
+// A cmdWriter pipes everything written to it through an external program.
+type cmdWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func startCmdWriter(w io.Writer, program string, args ...string) (*cmdWriter, error) {
+	c := &cmdWriter{cmd: exec.Command(program, args...)}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = &c.stderr
+
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.stdin = stdin
+
+	err = c.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Error starting %s: %s", program, err)
+	}
+
+	return c, nil
+}
+
+func (c *cmdWriter) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close waits for the program to finish writing its output.
+func (c *cmdWriter) Close() error {
+	c.stdin.Close()
+
+	err := c.cmd.Wait()
+	if err != nil {
+		msg := strings.TrimSpace(c.stderr.String())
+		if len(msg) > 0 {
+			return fmt.Errorf("%s failed: %s (%s)", c.cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("%s failed: %s", c.cmd.Args[0], err)
+	}
+	return nil
+}
+
+// A countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
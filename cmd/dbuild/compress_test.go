@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionFor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Flag     string
+		Path     string
+		Expected string
+	}{
+		{"", "image.tar", ""},
+		{"", "image", ""},
+		{"", "image.tar.gz", "gzip"},
+		{"", "IMAGE.TGZ", "gzip"},
+		{"", "image.tar.bz2", "bzip2"},
+		{"", "image.tar.xz", "xz"},
+		{"", "image.tar.zst", "zstd"},
+		{"gzip", "image.tar", "gzip"},
+		{"none", "image.tar.gz", ""},
+		{"xz", "image.tar.gz", "xz"},
+	}
+
+	for i, test := range tests {
+		format, err := compressionFor(test.Flag, test.Path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, format, test.Expected, "test %d", i)
+		}
+	}
+
+	_, err := compressionFor("lzma", "image.tar")
+	assert.EqualError(t, err, `Unknown compression format "lzma" (must be one of gzip, bzip2, xz, zstd or none)`)
+}
+
+func TestCheckCompression(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, checkCompression("", 0))
+	assert.NoError(t, checkCompression("gzip", 0))
+	assert.NoError(t, checkCompression("gzip", 9))
+	assert.EqualError(t, checkCompression("gzip", 10),
+		"Invalid gzip compression level 10 (must be between 1 and 9)")
+}
+
+func TestCompressWriter(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(strings.Repeat("hello docker ", 1000))
+
+	for _, format := range []string{"", "gzip", "bzip2", "xz", "zstd"} {
+		if p := compressionFormats[format]; p != nil && len(p.Program) > 0 {
+			if _, err := exec.LookPath(p.Program); err != nil {
+				t.Logf("Skipping %s: %s", format, err)
+				continue
+			}
+		}
+
+		var buf bytes.Buffer
+		counted := &countingWriter{w: &buf}
+		w, err := newCompressWriter(counted, format, 0)
+		if !assert.NoError(t, err, format) {
+			continue
+		}
+		_, err = w.Write(data)
+		assert.NoError(t, err, format)
+		assert.NoError(t, w.Close(), format)
+		assert.Equal(t, counted.n, int64(buf.Len()), format)
+
+		var decompressed []byte
+		switch format {
+		case "":
+			decompressed = buf.Bytes()
+		case "gzip":
+			r, err := gzip.NewReader(&buf)
+			if assert.NoError(t, err) {
+				decompressed, err = ioutil.ReadAll(r)
+				assert.NoError(t, err)
+			}
+		default:
+			cmd := exec.Command(compressionFormats[format].Program, "-d", "-c")
+			cmd.Stdin = &buf
+			decompressed, err = cmd.Output()
+			assert.NoError(t, err, format)
+		}
+		assert.Equal(t, decompressed, data, format)
+		if len(format) > 0 {
+			assert.True(t, counted.n < int64(len(data)), format)
+		}
+	}
+}
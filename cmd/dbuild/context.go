@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options that control what goes into the build context.
+type contextOptions struct {
+	// The Dockerfile to put at the root of the context, and the root
+	// directory of the context.
+	DockerfilePath string
+	RootPath       string
+
+	// The contents of the Dockerfile, if it's been rendered from a template.
+	// Otherwise, it's read from DockerfilePath.
+	Dockerfile []byte
+
+	// Paths to leave out of the context, from the .dockerignore file and
+	// from the command line.
+	Ignore  *IgnoreMatcher
+	Exclude *IgnoreMatcher
+
+	// If set, only files matching these patterns are added.
+	Include *IgnoreMatcher
+
+	// Whether to add files and directories whose names start with '.'.
+	IncludeHidden bool
+
+	// Whether to make everything in the context owned by root, rather than
+	// keeping the owner from the local filesystem.
+	NormalizeOwner bool
+
+	// Whether to make the context depend only on the names and contents of
+	// the files in it, so that the same inputs always give the same bytes.
+	Reproducible bool
+
+	// In reproducible mode, modification times later than this are clamped
+	// to it.  If it's zero, all modification times are set to the epoch.
+	SourceDateEpoch time.Time
+
+	// Shows the progress of writing the context, and counts what's in it, if
+	// it's set.
+	Progress *contextProgress
+
+	// Absolute paths that are never added, such as the build's own output.
+	Skip []string
+
+	// Files and directories from outside the root to add, and whether they
+	// replace anything in the root with the same name.  Otherwise, that's
+	// an error.
+	Adds         []contextAdd
+	OverrideAdds bool
+}
+
+// Calls the given function for every file, directory and symlink under the
+// root that belongs in the build context, with its path relative to the root,
+// and then for everything added from outside the root.
+func walkContext(opts *contextOptions, fn func(path, rel string, info os.FileInfo) error) error {
+	rootDockerfilePath := filepath.Join(opts.RootPath, "Dockerfile")
+
+	added, err := collectAdds(opts.Adds)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(opts.RootPath, func(path string, info os.FileInfo, err error) error {
+		// If there's an error, we just return it and abort the walk.
+		if err != nil {
+			return err
+		}
+
+		// Find the path relative to the root.  Everything below is matched
+		// against this path, since the root itself may well be hidden.
+		rel, err := filepath.Rel(opts.RootPath, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		slashRel := filepath.ToSlash(rel)
+
+		// Ignore paths that start with '.'
+		if !opts.IncludeHidden && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip anything that's ignored or excluded.  We can only skip an
+		// entire directory if nothing under it can be re-included.
+		for _, m := range []*IgnoreMatcher{opts.Ignore, opts.Exclude} {
+			if m != nil && m.Matches(slashRel) {
+				if info.IsDir() && m.CanSkipDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		// Anything that isn't included is left out, but we still descend
+		// into directories, since files under them might be included.
+		if opts.Include != nil && !opts.Include.Matches(slashRel) {
+			return nil
+		}
+
+		// We skip this file if the path is the same as our Dockerfile, and if
+		// it's in the root directory.  This is to avoid having two Dockerfiles
+		// in the root.
+		if path == rootDockerfilePath || contains(opts.Skip, path) {
+			return nil
+		}
+
+		// Added directories are merged with the root's, but anything else
+		// added in place of a file in the root replaces it.  A directory
+		// that's only implied by an added file is the root's.
+		if a, ok := added[slashRel]; ok {
+			if a.implicit && info.IsDir() {
+				delete(added, slashRel)
+				return fn(path, rel, info)
+			}
+			if a.info.IsDir() && info.IsDir() {
+				return nil
+			}
+			if !opts.OverrideAdds {
+				return fmt.Errorf("--add %s conflicts with %s in the root (use --add-override to replace it)",
+					a.from.Source, slashRel)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return fn(path, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, a := range sortedAdds(added) {
+		if err := fn(a.path, filepath.FromSlash(a.name), a.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the build context, as a TAR file, to the given writer.
+func writeContext(out io.Writer, opts *contextOptions) error {
+	cw := newContextWriter(out, opts)
+
+	// Write the Dockerfile into the build context.  We follow a symlinked
+	// Dockerfile, since the daemon needs the contents.
+	info, err := os.Stat(opts.DockerfilePath)
+	if err != nil {
+		return fmt.Errorf("Error opening Dockerfile: %s", err)
+	}
+
+	if opts.Dockerfile != nil {
+		err = cw.WriteContents("Dockerfile", info, opts.Dockerfile)
+		if opts.Progress != nil {
+			opts.Progress.Stats.Add("Dockerfile", int64(len(opts.Dockerfile)))
+		}
+	} else {
+		err = cw.WriteFile(opts.DockerfilePath, "Dockerfile", info)
+		if opts.Progress != nil {
+			opts.Progress.Add("Dockerfile", info)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing Dockerfile to build context: %s", err)
+	}
+
+	// Recursively search the root for other files and add those.
+	add := func(path, rel string, info os.FileInfo) error {
+		name := filepath.ToSlash(rel)
+		if opts.Progress != nil {
+			opts.Progress.Add(name, info)
+		}
+
+		// Add this file to the TAR file.
+		return cw.WriteFile(path, name, info)
+	}
+
+	if opts.Reproducible {
+		err = writeSorted(opts, add)
+	} else {
+		err = walkContext(opts, add)
+	}
+
+	if opts.Progress != nil {
+		opts.Progress.Finish()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error adding files to build context: %s", err)
+	}
+
+	err = cw.Close()
+	if err != nil {
+		return fmt.Errorf("Error finalizing build context: %s", err)
+	}
+
+	return nil
+}
+
+// A contextStream writes the build context into a pipe in the background, so
+// that the build can read it while it's being written.
+type contextStream struct {
+	*io.PipeReader
+
+	mu      sync.Mutex
+	stopped bool
+	err     error
+	done    chan struct{}
+}
+
+var errStreamStopped = errors.New("build finished before the context was sent")
+
+// Starts writing the build context.  Everything written is also copied to
+// the given writer.
+func streamContext(opts *contextOptions, tee io.Writer) *contextStream {
+	pr, pw := io.Pipe()
+	s := &contextStream{
+		PipeReader: pr,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		err := writeContext(io.MultiWriter(pw, tee), opts)
+
+		// Errors caused by Finish stopping us aren't interesting.  This is
+		// recorded before closing the pipe, so that a build that fails
+		// because of it will always find it.
+		s.mu.Lock()
+		if !s.stopped {
+			s.err = err
+		}
+		s.mu.Unlock()
+
+		pw.CloseWithError(err)
+		close(s.done)
+	}()
+
+	return s
+}
+
+// Finish stops writing the context, if the build didn't read all of it, and
+// returns any error that occurred while writing it.
+func (s *contextStream) Finish() error {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.PipeReader.CloseWithError(errStreamStopped)
+	<-s.done
+	return s.err
+}
+
+// Calls the given function for every file in the build context, sorted by
+// their names in the TAR file, rather than in the order that they're found.
+func writeSorted(opts *contextOptions, fn func(path, rel string, info os.FileInfo) error) error {
+	type entry struct {
+		path, rel, name string
+		info            os.FileInfo
+	}
+
+	var entries []entry
+	err := walkContext(opts, func(path, rel string, info os.FileInfo) error {
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			name += "/"
+		}
+		entries = append(entries, entry{path, rel, name, info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, e := range entries {
+		if err := fn(e.path, e.rel, e.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints the files that would be sent in the build context, along with their
+// sizes.
+func listContext(out io.Writer, opts *contextOptions) error {
+	info, err := os.Stat(opts.DockerfilePath)
+	if err != nil {
+		return fmt.Errorf("Error opening Dockerfile: %s", err)
+	}
+
+	size := info.Size()
+	if opts.Dockerfile != nil {
+		size = int64(len(opts.Dockerfile))
+	}
+
+	count := 1
+	total := size
+	fmt.Fprintf(out, "%12d  %s\n", size, "Dockerfile")
+
+	err = walkContext(opts, func(path, rel string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		count++
+		total += info.Size()
+		fmt.Fprintf(out, "%12d  %s\n", info.Size(), filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error listing build context: %s", err)
+	}
+
+	fmt.Fprintf(out, "%12d  total (%d files)\n", total, count)
+	return nil
+}
+
+// Identifies a file on disk, so that we can tell when two paths are hard
+// links to the same file.
+type fileID struct {
+	dev, ino uint64
+}
+
+// A contextWriter writes files to a TAR file, preserving their type, mode and
+// ownership, as well as any hard links between them.
+type contextWriter struct {
+	tw   *tar.Writer
+	opts *contextOptions
+
+	// The names that hard-linked files were first written as.
+	links map[fileID]string
+}
+
+func newContextWriter(out io.Writer, opts *contextOptions) *contextWriter {
+	return &contextWriter{
+		tw:    tar.NewWriter(out),
+		opts:  opts,
+		links: make(map[fileID]string),
+	}
+}
+
+// WriteFile adds the file at the given path to the TAR file, with the given
+// name.  Symlinks are written as symlinks rather than being followed, and a
+// file that is a hard link to one that's already been written is added as a
+// link to it.
+func (cw *contextWriter) WriteFile(path, name string, info os.FileInfo) error {
+	// Sockets can't be stored in a TAR file, and Docker ignores them too.
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+
+	var target string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		target, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if info.Mode().IsRegular() {
+		if id, linked := fileInode(info); linked {
+			if first, ok := cw.links[id]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				cw.links[id] = header.Name
+			}
+		}
+	}
+
+	err = cw.writeHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(cw.tw, f)
+	return err
+}
+
+// WriteContents adds a regular file with the given name and contents to the
+// TAR file, taking the rest of its metadata from info.
+func (cw *contextWriter) WriteContents(name string, info os.FileInfo, data []byte) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Size = int64(len(data))
+
+	if err = cw.writeHeader(header); err != nil {
+		return err
+	}
+	_, err = cw.tw.Write(data)
+	return err
+}
+
+// Writes a header, after normalizing it as the options require.
+func (cw *contextWriter) writeHeader(header *tar.Header) error {
+	if cw.opts.NormalizeOwner || cw.opts.Reproducible {
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	}
+	if cw.opts.Reproducible {
+		normalizeHeader(header, cw.opts.SourceDateEpoch)
+	}
+
+	return cw.tw.WriteHeader(header)
+}
+
+// Close finishes writing the TAR file.
+func (cw *contextWriter) Close() error {
+	return cw.tw.Close()
+}
+
+// Removes everything from a header that depends on the machine the context
+// was made on, rather than on the file itself.
+func normalizeHeader(header *tar.Header, epoch time.Time) {
+	if epoch.IsZero() {
+		header.ModTime = time.Unix(0, 0)
+	} else if header.ModTime.After(epoch) {
+		header.ModTime = epoch
+	}
+	header.ModTime = header.ModTime.Truncate(time.Second)
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.PAXRecords = nil
+
+	// Like git, we only keep track of whether a file is executable.
+	switch header.Typeflag {
+	case tar.TypeDir:
+		header.Mode = 0755
+	case tar.TypeSymlink:
+		header.Mode = 0777
+	default:
+		if header.Mode&0111 != 0 {
+			header.Mode = 0755
+		} else {
+			header.Mode = 0644
+		}
+	}
+}
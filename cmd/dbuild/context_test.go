@@ -0,0 +1,460 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustMatcher(t *testing.T, patterns ...string) *IgnoreMatcher {
+	m, err := NewIgnoreMatcher(patterns)
+	if err != nil {
+		t.Fatalf("Error creating matcher: %s", err)
+	}
+	return m
+}
+
+func TestContextHidden(t *testing.T) {
+	t.Parallel()
+
+	// Note: the root itself is hidden, to make sure that we only look at
+	// the path relative to it.
+	parent := makeTree(t, map[string]string{
+		".root/Dockerfile":    "FROM busybox",
+		".root/app.js":        "",
+		".root/.env":          "",
+		".root/.git/HEAD":     "",
+		".root/src/.hidden":   "",
+		".root/src/index.js":  "",
+		".root/src/.cache/db": "",
+	})
+	defer os.RemoveAll(parent)
+	root := filepath.Join(parent, ".root")
+
+	opts := &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+	}
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile",
+		"app.js",
+		"src/",
+		"src/index.js",
+	})
+
+	opts.IncludeHidden = true
+	assert.Equal(t, contextNames(t, opts), []string{
+		".env",
+		".git/",
+		".git/HEAD",
+		"Dockerfile",
+		"app.js",
+		"src/",
+		"src/.cache/",
+		"src/.cache/db",
+		"src/.hidden",
+		"src/index.js",
+	})
+}
+
+func TestContextIncludeExclude(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":        "FROM busybox",
+		"app.js":            "",
+		"src/index.js":      "",
+		"src/index_test.js": "",
+		"docs/index.md":     "",
+	})
+	defer os.RemoveAll(root)
+
+	opts := &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+		Exclude:        mustMatcher(t, "docs", "**/*_test.js"),
+	}
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile",
+		"app.js",
+		"src/",
+		"src/index.js",
+	})
+
+	// Exclusions win over inclusions.
+	opts.Include = mustMatcher(t, "src", "docs")
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile",
+		"src/",
+		"src/index.js",
+	})
+}
+
+func TestListContext(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":   "FROM busybox",
+		"app.js":       "12345",
+		"src/index.js": "1234567890",
+		".env":         "SECRET=1",
+	})
+	defer os.RemoveAll(root)
+
+	var buf bytes.Buffer
+	err := listContext(&buf, &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, buf.String(), ""+
+		"          12  Dockerfile\n"+
+		"           5  app.js\n"+
+		"          10  src/index.js\n"+
+		"          27  total (3 files)\n")
+}
+
+// Writes a build context and returns the headers of the entries in it, by
+// name.
+func contextHeaders(t *testing.T, opts *contextOptions) map[string]*tar.Header {
+	var buf bytes.Buffer
+
+	err := writeContext(&buf, opts)
+	if err != nil {
+		t.Fatalf("Error writing context: %s", err)
+	}
+
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading context: %s", err)
+		}
+		headers[hdr.Name] = hdr
+	}
+
+	return headers
+}
+
+func TestContextMetadata(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":   "FROM busybox",
+		"bin/run.sh":   "#!/bin/sh",
+		"data/a.txt":   "hello",
+		"empty/":       "",
+		"private.conf": "",
+	})
+	defer os.RemoveAll(root)
+
+	mustDo := func(err error) {
+		if err != nil {
+			t.Fatalf("Error creating test tree: %s", err)
+		}
+	}
+	mustDo(os.Chmod(filepath.Join(root, "bin/run.sh"), 0755))
+	mustDo(os.Chmod(filepath.Join(root, "private.conf"), 0600))
+	mustDo(os.Symlink("bin/run.sh", filepath.Join(root, "run")))
+	mustDo(os.Symlink("/does/not/exist", filepath.Join(root, "dangling")))
+	mustDo(os.Link(filepath.Join(root, "data/a.txt"), filepath.Join(root, "data/b.txt")))
+
+	opts := &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+	}
+	headers := contextHeaders(t, opts)
+
+	if assert.NotNil(t, headers["empty/"]) {
+		assert.Equal(t, headers["empty/"].Typeflag, byte(tar.TypeDir))
+	}
+
+	if assert.NotNil(t, headers["run"]) {
+		assert.Equal(t, headers["run"].Typeflag, byte(tar.TypeSymlink))
+		assert.Equal(t, headers["run"].Linkname, "bin/run.sh")
+	}
+	if assert.NotNil(t, headers["dangling"]) {
+		assert.Equal(t, headers["dangling"].Typeflag, byte(tar.TypeSymlink))
+		assert.Equal(t, headers["dangling"].Linkname, "/does/not/exist")
+	}
+
+	assert.Equal(t, headers["bin/run.sh"].Mode&0777, int64(0755))
+	assert.Equal(t, headers["private.conf"].Mode&0777, int64(0600))
+
+	// The hard-linked file is only written once.
+	a, b := headers["data/a.txt"], headers["data/b.txt"]
+	if assert.NotNil(t, a) && assert.NotNil(t, b) {
+		assert.Equal(t, a.Typeflag, byte(tar.TypeReg))
+		assert.Equal(t, a.Size, int64(5))
+		assert.Equal(t, b.Typeflag, byte(tar.TypeLink))
+		assert.Equal(t, b.Linkname, "data/a.txt")
+		assert.Equal(t, b.Size, int64(0))
+	}
+
+	opts.NormalizeOwner = true
+	for name, hdr := range contextHeaders(t, opts) {
+		assert.Equal(t, hdr.Uid, 0, name)
+		assert.Equal(t, hdr.Gid, 0, name)
+		assert.Equal(t, hdr.Uname, "", name)
+		assert.Equal(t, hdr.Gname, "", name)
+	}
+}
+
+func TestContextReproducible(t *testing.T) {
+	t.Parallel()
+
+	// The same files, created in a different order, with different times
+	// and permissions.
+	files := map[string]string{
+		"Dockerfile":  "FROM busybox",
+		"app.js":      "console.log(1)",
+		"a/b.txt":     "b",
+		"a.txt":       "a",
+		"bin/run.sh":  "#!/bin/sh",
+		"empty/dir/":  "",
+		"data/x.json": "{}",
+	}
+	root1 := makeTree(t, files)
+	defer os.RemoveAll(root1)
+	root2 := makeTree(t, files)
+	defer os.RemoveAll(root2)
+
+	old := time.Unix(1000000000, 0)
+	for name := range files {
+		path := filepath.Join(root2, filepath.FromSlash(name))
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("Error setting times: %s", err)
+		}
+	}
+	for _, root := range []string{root1, root2} {
+		if err := os.Chmod(filepath.Join(root, "bin/run.sh"), 0755); err != nil {
+			t.Fatalf("Error setting mode: %s", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root2, "bin/run.sh"), 0700); err != nil {
+		t.Fatalf("Error setting mode: %s", err)
+	}
+	if err := os.Chmod(filepath.Join(root2, "app.js"), 0600); err != nil {
+		t.Fatalf("Error setting mode: %s", err)
+	}
+
+	write := func(root string, epoch time.Time) []byte {
+		var buf bytes.Buffer
+		err := writeContext(&buf, &contextOptions{
+			DockerfilePath:  filepath.Join(root, "Dockerfile"),
+			RootPath:        root,
+			Reproducible:    true,
+			SourceDateEpoch: epoch,
+		})
+		if err != nil {
+			t.Fatalf("Error writing context: %s", err)
+		}
+		return buf.Bytes()
+	}
+
+	ctx1 := write(root1, time.Time{})
+	assert.Equal(t, ctx1, write(root2, time.Time{}))
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(ctx1))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, hdr.Name)
+
+		assert.Equal(t, hdr.ModTime.Unix(), int64(0), hdr.Name)
+		assert.Equal(t, hdr.Uid, 0, hdr.Name)
+		switch hdr.Name {
+		case "bin/run.sh", "a/", "bin/":
+			assert.Equal(t, hdr.Mode, int64(0755), hdr.Name)
+		case "app.js":
+			assert.Equal(t, hdr.Mode, int64(0644), hdr.Name)
+		}
+	}
+	assert.Equal(t, names, []string{
+		"Dockerfile",
+		"a.txt",
+		"a/",
+		"a/b.txt",
+		"app.js",
+		"bin/",
+		"bin/run.sh",
+		"data/",
+		"data/x.json",
+		"empty/",
+		"empty/dir/",
+	})
+
+	// Times after the epoch are clamped to it, and earlier ones are kept.
+	epoch := time.Unix(1200000000, 0)
+	headers := contextHeaders(t, &contextOptions{
+		DockerfilePath:  filepath.Join(root2, "Dockerfile"),
+		RootPath:        root2,
+		Reproducible:    true,
+		SourceDateEpoch: epoch,
+	})
+	assert.Equal(t, headers["a.txt"].ModTime.Unix(), old.Unix())
+
+	headers = contextHeaders(t, &contextOptions{
+		DockerfilePath:  filepath.Join(root1, "Dockerfile"),
+		RootPath:        root1,
+		Reproducible:    true,
+		SourceDateEpoch: epoch,
+	})
+	assert.Equal(t, headers["a.txt"].ModTime.Unix(), epoch.Unix())
+}
+
+func TestStreamContext(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":   "FROM busybox",
+		"app.js":       strings.Repeat("x", 100000),
+		"src/index.js": "",
+	})
+	defer os.RemoveAll(root)
+
+	opts := &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+		Reproducible:   true,
+	}
+
+	var expected bytes.Buffer
+	assert.NoError(t, writeContext(&expected, opts))
+
+	// Reading everything gives the same context, and a copy of it.
+	var tee bytes.Buffer
+	stream := streamContext(opts, &tee)
+	data, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Finish())
+	assert.Equal(t, data, expected.Bytes())
+	assert.Equal(t, tee.Bytes(), expected.Bytes())
+
+	// Stopping part-way through isn't an error, and doesn't hang.
+	stream = streamContext(opts, ioutil.Discard)
+	_, err = stream.Read(make([]byte, 512))
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Finish())
+
+	// Errors from writing the context reach the reader, and are returned.
+	opts.DockerfilePath = filepath.Join(root, "Missing")
+	stream = streamContext(opts, ioutil.Discard)
+	_, err = ioutil.ReadAll(stream)
+	assert.Error(t, err)
+	assert.EqualError(t, stream.Finish(), err.Error())
+	assert.Contains(t, err.Error(), "Error opening Dockerfile")
+}
+
+func TestContextAdd(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":      "FROM busybox",
+		"app.js":          "",
+		"config/app.conf": "root",
+	})
+	defer os.RemoveAll(root)
+
+	shared := makeTree(t, map[string]string{
+		"ca.pem":        "cert",
+		"conf/app.conf": "shared",
+		"conf/db.conf":  "",
+	})
+	defer os.RemoveAll(shared)
+
+	mustAdd := func(arg string) contextAdd {
+		add, err := parseAdd(arg)
+		if err != nil {
+			t.Fatalf("Error parsing --add: %s", err)
+		}
+		return add
+	}
+
+	// Files can go anywhere, and directories are merged.
+	opts := &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+		Adds: []contextAdd{
+			mustAdd(filepath.Join(shared, "ca.pem") + ":/certs/ca.pem"),
+			mustAdd(filepath.Join(shared, "conf") + ":config/shared"),
+		},
+	}
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile",
+		"app.js",
+		"certs/",
+		"certs/ca.pem",
+		"config/",
+		"config/app.conf",
+		"config/shared/",
+		"config/shared/app.conf",
+		"config/shared/db.conf",
+	})
+
+	// Replacing a file in the root is an error, unless asked for.
+	opts.Adds = []contextAdd{mustAdd(filepath.Join(shared, "conf") + ":config")}
+	var buf bytes.Buffer
+	err := writeContext(&buf, opts)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "config/app.conf")
+	}
+
+	opts.OverrideAdds = true
+	headers := contextHeaders(t, opts)
+	if assert.NotNil(t, headers["config/app.conf"]) {
+		assert.Equal(t, headers["config/app.conf"].Size, int64(len("shared")))
+	}
+	assert.NotNil(t, headers["config/db.conf"])
+
+	// A file can replace a whole directory.
+	opts.Adds = []contextAdd{mustAdd(filepath.Join(shared, "ca.pem") + ":config")}
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile",
+		"app.js",
+		"config",
+	})
+
+	// The directories that an added file goes in can't replace a file in
+	// the root either.
+	opts.OverrideAdds = false
+	opts.Adds = []contextAdd{mustAdd(filepath.Join(shared, "ca.pem") + ":app.js/ca.pem")}
+	err = writeContext(&buf, opts)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "conflicts with app.js")
+	}
+
+	opts.OverrideAdds = true
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile",
+		"app.js/",
+		"app.js/ca.pem",
+		"config/",
+		"config/app.conf",
+	})
+
+	// The Dockerfile can't be replaced.
+	opts.Adds = []contextAdd{mustAdd(filepath.Join(shared, "ca.pem") + ":Dockerfile")}
+	assert.Error(t, writeContext(&buf, opts))
+
+	for _, arg := range []string{"nodest", ":dest", "src:", "src:/", "src:../.."} {
+		_, err := parseAdd(arg)
+		assert.Error(t, err, "parsing %q", arg)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// An ignorePattern is a single line from a .dockerignore file.
+type ignorePattern struct {
+	pattern   string
+	exclusion bool
+	re        *regexp.Regexp
+}
+
+// IgnoreMatcher decides whether paths in the build context should be left
+// out, using the same rules as Docker's .dockerignore:
+//
+//   - Patterns are matched against the path relative to the root, using
+//     '/' as the separator.  '*' and '?' don't match '/', and '**' matches
+//     any number of directories.
+//   - A pattern that matches a directory also matches everything under it.
+//   - A pattern starting with '!' is an exception, and re-includes paths
+//     that an earlier pattern excluded.  The last matching pattern wins.
+type IgnoreMatcher struct {
+	patterns      []*ignorePattern
+	hasExceptions bool
+}
+
+// ReadIgnoreFile parses the given .dockerignore file.  If the file doesn't
+// exist, the returned matcher doesn't ignore anything.
+func ReadIgnoreFile(path string) (*IgnoreMatcher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &IgnoreMatcher{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseIgnoreFile(f)
+}
+
+// ParseIgnoreFile parses .dockerignore patterns from the given reader.
+func ParseIgnoreFile(r io.Reader) (*IgnoreMatcher, error) {
+	lines := []string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewIgnoreMatcher(lines)
+}
+
+// NewIgnoreMatcher creates a matcher from a list of patterns.
+func NewIgnoreMatcher(patterns []string) (*IgnoreMatcher, error) {
+	ret := &IgnoreMatcher{}
+
+	for _, p := range patterns {
+		pat := &ignorePattern{}
+
+		if len(p) == 0 {
+			return nil, fmt.Errorf("Empty pattern")
+		}
+		if p[0] == '!' {
+			if len(p) == 1 {
+				return nil, fmt.Errorf("Illegal exclusion pattern: %q", p)
+			}
+			pat.exclusion = true
+			ret.hasExceptions = true
+			p = p[1:]
+		}
+
+		p = filepath.ToSlash(filepath.Clean(p))
+		p = strings.TrimPrefix(p, "/")
+		if len(p) == 0 || p == "." {
+			continue
+		}
+
+		re, err := compileIgnorePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %s", p, err)
+		}
+
+		pat.pattern = p
+		pat.re = re
+		ret.patterns = append(ret.patterns, pat)
+	}
+
+	return ret, nil
+}
+
+// Converts a pattern into an anchored regular expression.
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+
+		switch ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+
+				// '**/' matches zero or more directories.
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					buf.WriteString("(.*/)?")
+				} else {
+					buf.WriteString(".*")
+				}
+			} else {
+				buf.WriteString("[^/]*")
+			}
+
+		case '?':
+			buf.WriteString("[^/]")
+
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end
+
+		case '\\':
+			if i+1 >= len(pattern) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			buf.WriteString(regexp.QuoteMeta(string(pattern[i])))
+
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+func (p *ignorePattern) match(path string) bool {
+	if p.re.MatchString(path) {
+		return true
+	}
+
+	// A pattern that matches a parent directory matches everything in it.
+	// Since '**' can match any number of directories, every parent has to
+	// be tried.
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if p.re.MatchString(strings.Join(parts[:i], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns whether the given path (relative to the root, with '/' as
+// the separator) should be left out of the build context.
+func (m *IgnoreMatcher) Matches(path string) bool {
+	matched := false
+
+	for _, p := range m.patterns {
+		// Exceptions only matter for paths that are excluded, and vice
+		// versa.
+		if p.exclusion != matched {
+			continue
+		}
+
+		if p.match(path) {
+			matched = !p.exclusion
+		}
+	}
+
+	return matched
+}
+
+// CanSkipDir returns whether an ignored directory can be skipped entirely.
+// If there are any exceptions, something under it may be re-included, so we
+// must keep walking.
+func (m *IgnoreMatcher) CanSkipDir() bool {
+	return !m.hasExceptions
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a temporary directory containing the given files.  Files whose
+// names end in '/' are created as (empty) directories.
+func makeTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dbuild-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		if strings.HasSuffix(name, "/") {
+			err = os.MkdirAll(path, 0755)
+		} else {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(path, []byte(contents), 0644)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Error creating %s: %s", name, err)
+		}
+	}
+
+	return dir
+}
+
+// Writes a build context and returns the sorted names of the entries in it.
+func contextNames(t *testing.T, opts *contextOptions) []string {
+	var buf bytes.Buffer
+
+	err := writeContext(&buf, opts)
+	if err != nil {
+		t.Fatalf("Error writing context: %s", err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading context: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Patterns []string
+		Path     string
+		Expected bool
+	}{
+		// Plain names and wildcards.
+		{[]string{"foo"}, "foo", true},
+		{[]string{"foo"}, "foobar", false},
+		{[]string{"*.log"}, "debug.log", true},
+		{[]string{"*.log"}, "logs/debug.log", false},
+		{[]string{"*/*.log"}, "logs/debug.log", true},
+		{[]string{"file?.txt"}, "file1.txt", true},
+		{[]string{"file?.txt"}, "file10.txt", false},
+		{[]string{"file[0-9].txt"}, "file5.txt", true},
+		{[]string{"file[!0-9].txt"}, "file5.txt", false},
+		{[]string{"/foo"}, "foo", true},
+		{[]string{"./foo"}, "foo", true},
+
+		// '**' matches any number of directories.
+		{[]string{"**/*.log"}, "debug.log", true},
+		{[]string{"**/*.log"}, "a/b/c/debug.log", true},
+		{[]string{"a/**/z"}, "a/z", true},
+		{[]string{"a/**/z"}, "a/b/c/z", true},
+		{[]string{"a/**"}, "a/b/c", true},
+		{[]string{"a/**"}, "b/c", false},
+		{[]string{"**/node_modules"}, "node_modules/x.js", true},
+		{[]string{"**/node_modules"}, "a/node_modules/x.js", true},
+		{[]string{"**/node_modules"}, "a/b/node_modules/x.js", true},
+		{[]string{"**/node_modules"}, "a/b/node_modules_x.js", false},
+
+		// Directory patterns match everything under the directory.
+		{[]string{"node_modules"}, "node_modules/foo/index.js", true},
+		{[]string{"build/"}, "build/out.o", true},
+		{[]string{"src/gen"}, "src/gen/x.go", true},
+		{[]string{"src/gen"}, "src/general.go", false},
+
+		// Exceptions re-include paths, and the last match wins.
+		{[]string{"*.md", "!README.md"}, "README.md", false},
+		{[]string{"*.md", "!README.md"}, "CHANGES.md", true},
+		{[]string{"*.md", "!README.md", "README*"}, "README.md", true},
+		{[]string{"docs", "!docs/keep.txt"}, "docs/keep.txt", false},
+		{[]string{"docs", "!docs/keep.txt"}, "docs/other.txt", true},
+		{[]string{"!foo"}, "foo", false},
+		{[]string{"**/node_modules", "!keep.js"}, "node_modules/x.js", true},
+		{[]string{"**/node_modules", "!node_modules/keep.js"}, "node_modules/keep.js", false},
+		{[]string{"**/node_modules", "!a/b/keep.js"}, "a/b/node_modules/x.js", true},
+		{[]string{"**/node_modules", "!**/keep.js"}, "a/b/node_modules/keep.js", false},
+	}
+
+	for i, test := range tests {
+		m, err := NewIgnoreMatcher(test.Patterns)
+		if err != nil {
+			t.Errorf("[%d] Error creating matcher: %s", i, err)
+			continue
+		}
+
+		if m.Matches(test.Path) != test.Expected {
+			t.Errorf("[%d] Patterns %q, path %q: expected %t", i,
+				test.Patterns, test.Path, test.Expected)
+		}
+	}
+}
+
+func TestIgnoreMatcherInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewIgnoreMatcher([]string{"!"})
+	assert.EqualError(t, err, `Illegal exclusion pattern: "!"`)
+
+	// As given by --exclude= or --include=.
+	_, err = NewIgnoreMatcher([]string{""})
+	assert.EqualError(t, err, "Empty pattern")
+
+	_, err = NewIgnoreMatcher([]string{"foo["})
+	assert.EqualError(t, err, `Invalid pattern "foo[": unterminated character class`)
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	t.Parallel()
+
+	m, err := ParseIgnoreFile(strings.NewReader(`
+# Comments and blank lines are skipped.
+
+*.log
+  !keep.log
+`))
+	assert.NoError(t, err)
+	assert.True(t, m.Matches("debug.log"))
+	assert.False(t, m.Matches("keep.log"))
+	assert.False(t, m.Matches("# Comments and blank lines are skipped."))
+}
+
+func TestReadIgnoreFileMissing(t *testing.T) {
+	t.Parallel()
+
+	m, err := ReadIgnoreFile("/does/not/exist/.dockerignore")
+	assert.NoError(t, err)
+	assert.False(t, m.Matches("foo"))
+}
+
+func TestContextIgnore(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile.real":               "FROM busybox",
+		"app.js":                        "",
+		"README.md":                     "",
+		"CHANGES.md":                    "",
+		"debug.log":                     "",
+		"src/index.js":                  "",
+		"src/lib/util.js":               "",
+		"src/lib/util.log":              "",
+		"node_modules/left-pad/main.js": "",
+		"build/out.o":                   "",
+		"build/keep/out.o":              "",
+		".dockerignore": strings.Join([]string{
+			"node_modules",
+			"**/*.log",
+			"*.md",
+			"!README.md",
+			"build/",
+			"!build/keep",
+			"Dockerfile.real",
+		}, "\n"),
+	})
+	defer os.RemoveAll(root)
+
+	ignore, err := ReadIgnoreFile(filepath.Join(root, ".dockerignore"))
+	assert.NoError(t, err)
+
+	names := contextNames(t, &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile.real"),
+		RootPath:       root,
+		Ignore:         ignore,
+	})
+	assert.Equal(t, names, []string{
+		"Dockerfile",
+		"README.md",
+		"app.js",
+		"build/keep/",
+		"build/keep/out.o",
+		"src/",
+		"src/index.js",
+		"src/lib/",
+		"src/lib/util.js",
+	})
+}
+
+func TestContextIgnoreAnyDepth(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":                    "FROM busybox",
+		"node_modules/x.js":             "",
+		"node_modules/keep.js":          "",
+		"a/b/node_modules/x.js":         "",
+		"a/b/node_modules/keep.js":      "",
+		"a/b/node_modules_not/index.js": "",
+		".dockerignore": strings.Join([]string{
+			"**/node_modules",
+			"!**/keep.js",
+		}, "\n"),
+	})
+	defer os.RemoveAll(root)
+
+	ignore, err := ReadIgnoreFile(filepath.Join(root, ".dockerignore"))
+	assert.NoError(t, err)
+
+	// The exception means ignored directories are walked, so each file in
+	// them has to be matched at any depth.
+	names := contextNames(t, &contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+		Ignore:         ignore,
+	})
+	assert.Equal(t, names, []string{
+		"Dockerfile",
+		"a/",
+		"a/b/",
+		"a/b/node_modules/keep.js",
+		"a/b/node_modules_not/",
+		"a/b/node_modules_not/index.js",
+		"node_modules/keep.js",
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/andrew-d/docker-tools/exitcode"
+)
+
+// The codes that dbuild exits with.  These are documented in the usage
+// message, so they mustn't change.
+const (
+	exitOK         = exitcode.OK
+	exitFailure    = exitcode.Failure    // a build, or whatever else was asked for, failed
+	exitUsage      = exitcode.Usage      // invalid arguments
+	exitConfig     = exitcode.Config     // invalid options, manifest or inputs
+	exitConnection = exitcode.Connection // can't connect to Docker
+	exitPartial    = exitcode.Partial    // built, but some tags, pushes, loads or images failed
+)
+
+// Returned when the arguments are invalid, to show the usage message.
+var errUsage = exitcode.With(exitUsage, errors.New("Invalid arguments"))
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+)
+
+// stringList is a flag that can be given multiple times, collecting each
+// value.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
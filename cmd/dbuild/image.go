@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/exitcode"
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// An imageBuild is everything needed to build, export and publish a single
+// image.
+type imageBuild struct {
+	Context *contextOptions
+
+	// The name to build the image as, and other names to tag it with.
+	Name string
+	Tags []string
+
+	// Whether the name was made up, rather than given.
+	GeneratedName bool
+
+	// Where to export the image to, if anywhere, and how to compress it.
+	OutputPath    string
+	Compression   string
+	CompressLevel int
+
+	// Whether to push the tags, and the registry credentials to do it with.
+	Push  bool
+	Auths map[string]docker.AuthConfiguration
+
+	NoCache bool
+	Rm      bool
+	ForceRm bool
+	RmAfter bool
+	Stream  bool
+
+	// Whether to flatten the image into a single layer before exporting it.
+	Squash bool
+
+	// Other Docker hosts to load the image into as it's exported.
+	LoadInto []*dockerconn.Conn
+
+	// Whether to write an integrity manifest next to the output file, and
+	// the key to sign it with, if any.
+	Integrity bool
+	SignKey   ed25519.PrivateKey
+
+	// A file to save the build's output to.
+	BuildLog string
+
+	// The largest build context that may be sent, if there's a limit, and
+	// how many of its largest files and directories to show.
+	MaxContextSize int64
+	ShowLargest    int
+
+	// Whether to build even if the inputs haven't changed since the output
+	// file was last built, and where to keep records of those builds.
+	Force    bool
+	CacheDir string
+
+	// Put in front of log messages and build output, to tell images apart
+	// when several are built at once.
+	Prefix string
+
+	// Filled in by Run.
+	ImageID       string
+	ImageSize     int64
+	ContextSHA256 string
+	OutputSize    int64
+	OutputSHA256  string
+	Unchanged     bool
+}
+
+func (b *imageBuild) infof(format string, a ...interface{}) {
+	log.Infof(b.Prefix+format, a...)
+}
+
+// Run builds the image, and then exports, tags and pushes it.  If the output
+// file was already built from the same inputs, nothing is done.
+func (b *imageBuild) Run(conn *dockerconn.Conn) (err error) {
+	client := conn.Client
+
+	var inputs, recordPath string
+	if len(b.OutputPath) > 0 {
+		var err error
+		recordPath, err = buildRecordPath(b.OutputPath, b.CacheDir)
+		if err != nil {
+			return fmt.Errorf("Error finding build record: %s", err)
+		}
+
+		// The output of a previous build isn't an input to this one, even if
+		// it's under the root.
+		outputPath, err := filepath.Abs(b.OutputPath)
+		if err != nil {
+			return fmt.Errorf("Error finding absolute path: %s", err)
+		}
+		b.Context.Skip = append(b.Context.Skip, outputPath, recordPath)
+
+		inputs, err = b.inputsHash()
+		if err != nil {
+			return fmt.Errorf("Error hashing build inputs: %s", err)
+		}
+
+		unchanged, reason, err := b.checkRecord(recordPath, inputs)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			b.infof("Inputs unchanged (hash %s), skipping build of %s", inputs, b.OutputPath)
+			b.Unchanged = true
+			return nil
+		}
+		b.infof("Inputs hash %s: building, since %s", inputs, reason)
+	}
+
+	// Create the output file first, so we don't build for nothing if we
+	// can't write it.  It only replaces the real one once it's complete, so
+	// that a failed build doesn't leave a partial file behind.
+	var outf *outputFile
+	if len(b.OutputPath) > 0 {
+		outf, err = createOutputFile(b.OutputPath)
+		if err != nil {
+			return fmt.Errorf("Error creating output file: %s", err)
+		}
+		defer outf.Abort()
+
+		// The context's paths are absolute, even if the output's isn't.
+		tmpPath, err := filepath.Abs(outf.Name())
+		if err != nil {
+			return fmt.Errorf("Error finding absolute path: %s", err)
+		}
+		b.Context.Skip = append(b.Context.Skip, tmpPath)
+	}
+
+	if err := b.build(conn); err != nil {
+		return err
+	}
+
+	// From here on, the image exists.  With --rm-after, it's removed, along
+	// with any tags, however the rest of the build goes.
+	var tagged, unsquashed []string
+	if b.RmAfter {
+		defer func() {
+			if rmErr := b.removeImage(client, append(tagged, unsquashed...)); err == nil {
+				err = rmErr
+			}
+		}()
+	}
+
+	// Inspect the image to get information.
+	img, err := client.InspectImage(b.Name)
+	if err != nil {
+		return fmt.Errorf("Error inspecting image: %s", err)
+	}
+	b.ImageID = img.ID
+	b.ImageSize = img.Size
+	b.infof("Image built (size = %d)", img.Size)
+
+	if b.Squash {
+		b.infof("Squashing image, please wait...")
+		flat, err := squashImage(client, img, b.Name)
+		if err != nil {
+			return err
+		}
+		b.ImageID = flat.ID
+		b.ImageSize = flat.Size
+		unsquashed = []string{img.ID}
+		b.infof("Image squashed (size = %d, was %d)", flat.Size, img.Size)
+	}
+
+	// Export the image to the output file, and load it into other hosts.
+	var loadFailed []string
+	if outf != nil || len(b.LoadInto) > 0 {
+		var w io.Writer
+		if outf != nil {
+			w = outf
+		}
+
+		loadFailed, err = b.export(client, w)
+		if err != nil {
+			return err
+		}
+
+		if outf != nil {
+			if err = outf.Commit(); err != nil {
+				return fmt.Errorf("Error saving output file: %s", err)
+			}
+		}
+	}
+
+	// Tag and push the image.  A failure with one tag doesn't stop us from
+	// trying the others.
+	failed := tagImage(client, b.Name, b.Tags)
+	for _, tag := range b.Tags {
+		if !contains(failed, tag) {
+			tagged = append(tagged, tag)
+		}
+	}
+	if b.Push {
+		failed = append(failed, pushTags(client, tagged, b.Auths, os.Stdout)...)
+	}
+
+	// The output file is complete even if some of those failed, so its
+	// manifest and build record are still written.
+	if outf != nil && (b.Integrity || b.SignKey != nil) {
+		// Reproducible builds record the source's date, rather than today's.
+		builtAt := time.Now()
+		if !b.Context.SourceDateEpoch.IsZero() {
+			builtAt = b.Context.SourceDateEpoch
+		}
+		err = writeIntegrity(b.OutputPath, &integrityManifest{
+			ImageID:       b.ImageID,
+			Name:          b.Name,
+			Tags:          b.Tags,
+			BuiltAt:       builtAt.UTC().Truncate(time.Second),
+			ContextSHA256: b.ContextSHA256,
+			OutputFile:    filepath.Base(b.OutputPath),
+			OutputSHA256:  b.OutputSHA256,
+			OutputSize:    b.OutputSize,
+		}, b.SignKey)
+		if err != nil {
+			return fmt.Errorf("Error writing integrity manifest: %s", err)
+		}
+		b.infof("Wrote integrity manifest to %s", integrityPath(b.OutputPath))
+	}
+
+	// The next build is only skipped if nothing failed, so that failed tags
+	// and pushes are retried.
+	if outf != nil {
+		err = writeBuildRecord(recordPath, &buildRecord{
+			Inputs:       inputs,
+			OutputSize:   b.OutputSize,
+			OutputSHA256: b.OutputSHA256,
+			Failed:       failed,
+		})
+		if err != nil {
+			return fmt.Errorf("Error saving build record: %s", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return exitcode.Errorf(exitPartial, "Failed to tag or push: %s", strings.Join(failed, ", "))
+	}
+	if len(loadFailed) > 0 {
+		return exitcode.Errorf(exitPartial, "Failed to load into: %s", strings.Join(loadFailed, ", "))
+	}
+	return nil
+}
+
+// Removes the image, and then the given other names or IDs: its tags, and
+// the original image, if it was squashed.
+func (b *imageBuild) removeImage(client *docker.Client, others []string) error {
+	b.infof("Removing image...")
+
+	var failed []string
+	for _, name := range append([]string{b.Name}, others...) {
+		if err := client.RemoveImage(name); err != nil {
+			log.Errorf("%sError removing image %s: %s", b.Prefix, name, err)
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to remove: %s", strings.Join(failed, ", "))
+	}
+	b.infof("Image removed")
+	return nil
+}
+
+// Checks whether the output file was last built from the given inputs.  If
+// it wasn't, the reason why is returned.
+func (b *imageBuild) checkRecord(recordPath, inputs string) (bool, string, error) {
+	if b.Force {
+		return false, "--force was given", nil
+	}
+	if len(b.LoadInto) > 0 {
+		return false, "--load-into was given", nil
+	}
+
+	record, err := readBuildRecord(recordPath)
+	if err != nil {
+		return false, "", fmt.Errorf("Error reading build record: %s", err)
+	}
+	if record == nil {
+		return false, "there's no record of a previous build", nil
+	}
+	if record.Inputs != inputs {
+		return false, "the inputs have changed", nil
+	}
+	if len(record.Failed) > 0 {
+		return false, "tagging or pushing failed last time", nil
+	}
+
+	matches, err := record.Matches(inputs, b.OutputPath)
+	if err != nil {
+		return false, "", fmt.Errorf("Error checking output file: %s", err)
+	}
+	if !matches {
+		return false, "the output file is missing or has changed", nil
+	}
+	if b.Integrity || b.SignKey != nil {
+		if _, err := os.Stat(integrityPath(b.OutputPath)); err != nil {
+			return false, "the integrity manifest is missing", nil
+		}
+	}
+	return true, "", nil
+}
+
+// Sends the build context to Docker, and builds the image from it.
+func (b *imageBuild) build(conn *dockerconn.Conn) error {
+	// Check the context's size before sending any of it.
+	if b.MaxContextSize > 0 {
+		stats, err := scanContext(b.Context)
+		if err != nil {
+			return err
+		}
+		if stats.Bytes > b.MaxContextSize {
+			stats.Print(os.Stdout, b.Prefix, b.ShowLargest)
+			return fmt.Errorf("Build context is %s, which is more than the maximum of %s",
+				formatBytes(stats.Bytes), formatBytes(b.MaxContextSize))
+		}
+	}
+
+	// Builds running at once can't share a progress line.
+	progress := newContextProgress(os.Stdout, b.Prefix, len(b.Prefix) == 0 && isTerminal(os.Stdout))
+	b.Context.Progress = progress
+
+	// The context is hashed as it's written, so that reproducible builds
+	// can be compared.
+	hash := sha256.New()
+	var (
+		buildctx      io.Reader
+		finishContext = func() error { return nil }
+	)
+
+	if b.Stream {
+		// Tar the context while the daemon reads it.  It's only finished once
+		// the build has read all of it.
+		b.infof("Streaming build context to Docker")
+		stream := streamContext(b.Context, hash)
+		buildctx = stream
+		finishContext = stream.Finish
+	} else {
+		// Create our build context tar file.
+		ctxf, err := ioutil.TempFile("", "dbuild-ctx")
+		if err != nil {
+			return fmt.Errorf("Error creating temporary build context file: %s", err)
+		}
+		defer os.Remove(ctxf.Name())
+		defer ctxf.Close()
+
+		b.infof("Adding files to build context...")
+		err = writeContext(io.MultiWriter(ctxf, hash), b.Context)
+		if err != nil {
+			return err
+		}
+		b.infof("Finished adding build context")
+		progress.Stats.Print(os.Stdout, b.Prefix, b.ShowLargest)
+		if b.Context.Reproducible {
+			b.infof("Build context SHA-256: %x", hash.Sum(nil))
+		}
+
+		// Need to rewind our tar file handle to the beginning.
+		_, err = ctxf.Seek(0, 0)
+		if err != nil {
+			return fmt.Errorf("Error seeking to beginning of build context: %s", err)
+		}
+		buildctx = ctxf
+	}
+
+	b.infof("Using image name: %s", b.Name)
+
+	// Set up build options.  Note that the escape at the end resets the
+	// terminal color.
+	prefix := "   [build] "
+	if len(b.Prefix) > 0 {
+		prefix = "   [" + strings.TrimSuffix(b.Prefix, ": ") + "] "
+	}
+	output := NewLineStreamer(os.Stdout, prefix, "\x1b[0m")
+	var buildLog io.Writer
+	if len(b.BuildLog) > 0 {
+		logf, err := os.Create(b.BuildLog)
+		if err != nil {
+			return fmt.Errorf("Error creating build log: %s", err)
+		}
+		defer logf.Close()
+		buildLog = logf
+	}
+	reporter := newBuildReporter(output, buildLog)
+
+	opts := docker.BuildImageOptions{
+		Name:                b.Name,
+		InputStream:         buildctx,
+		NoCache:             b.NoCache,
+		RmTmpContainer:      b.Rm,
+		ForceRmTmpContainer: b.ForceRm,
+	}
+
+	// Send everything off for building
+	b.infof("Starting to build image, please wait...")
+	err := buildImage(conn, opts, reporter)
+	reporter.Summary(os.Stdout)
+
+	// An error writing the context will also have failed the build, but is
+	// more useful to report.
+	if ctxErr := finishContext(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error building image: %s", err)
+	}
+
+	// If the build failed, the daemon may have stopped reading the context
+	// early, so it's only described once we know it was all sent.
+	if b.Stream {
+		progress.Stats.Print(os.Stdout, b.Prefix, b.ShowLargest)
+		if b.Context.Reproducible {
+			b.infof("Build context SHA-256: %x", hash.Sum(nil))
+		}
+	}
+	b.ContextSHA256 = hex.EncodeToString(hash.Sum(nil))
+	b.infof("Finished building image")
+	return nil
+}
+
+// Exports the image to the given file, if any, compressing it on the way.
+// At the same time, it's loaded into the other Docker hosts, and the ones it
+// couldn't be loaded into are returned.
+func (b *imageBuild) export(client *docker.Client, outf io.Writer) ([]string, error) {
+	if outf == nil {
+		outf = ioutil.Discard
+	}
+
+	outHash := sha256.New()
+	compressed := &countingWriter{w: io.MultiWriter(outf, outHash)}
+	compressor, err := newCompressWriter(compressed, b.Compression, b.CompressLevel)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting compression: %s", err)
+	}
+
+	// Docker hosts are sent the image uncompressed.
+	var (
+		out    io.Writer = compressor
+		loader *imageLoader
+	)
+	if len(b.LoadInto) > 0 {
+		loader = startLoads(b.LoadInto, b.Prefix)
+		out = io.MultiWriter(compressor, loader)
+	}
+	uncompressed := &countingWriter{w: out}
+
+	exportOpts := docker.ExportImageOptions{
+		Name:         b.Name,
+		OutputStream: uncompressed,
+	}
+
+	b.infof("Exporting built image, please wait...")
+	err = client.ExportImage(exportOpts)
+	if err != nil {
+		err = fmt.Errorf("Error exporting image: %s", err)
+	}
+
+	var loadFailed []string
+	if loader != nil {
+		loadFailed = loader.Finish(err)
+	}
+
+	if err != nil {
+		compressor.Close()
+		return loadFailed, err
+	}
+
+	err = compressor.Close()
+	if err != nil {
+		return loadFailed, fmt.Errorf("Error compressing image: %s", err)
+	}
+	b.infof("Finished exporting")
+
+	b.OutputSize = compressed.n
+	b.OutputSHA256 = hex.EncodeToString(outHash.Sum(nil))
+	if len(b.Compression) > 0 {
+		b.infof("Exported image size: %d bytes (%d bytes before %s compression)",
+			compressed.n, uncompressed.n, b.Compression)
+	} else {
+		b.infof("Exported image size: %d bytes", uncompressed.n)
+	}
+	return loadFailed, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
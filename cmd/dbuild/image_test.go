@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageBuildRun(t *testing.T) {
+	t.Parallel()
+
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	defer server.Stop()
+
+	conn := newTestConn(t, server.URL())
+	client := conn.Client
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+		"app.js":     "",
+	})
+	defer os.RemoveAll(root)
+
+	b := &imageBuild{
+		Context: &contextOptions{
+			DockerfilePath:  filepath.Join(root, "Dockerfile"),
+			RootPath:        root,
+			Reproducible:    true,
+			SourceDateEpoch: time.Unix(1400000000, 0),
+		},
+		Name:        "myapp",
+		OutputPath:  filepath.Join(root, "myapp.tar.gz"),
+		Compression: "gzip",
+		RmAfter:     true,
+		Stream:      true,
+		Integrity:   true,
+	}
+	err = b.Run(conn)
+	assert.NoError(t, err)
+
+	// The fake server exports an empty image, but it should still be
+	// compressed.
+	f, err := os.Open(b.OutputPath)
+	if assert.NoError(t, err) {
+		defer f.Close()
+
+		r, err := gzip.NewReader(f)
+		if assert.NoError(t, err) {
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, len(data), 0)
+		}
+	}
+	info, err := os.Stat(b.OutputPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, b.OutputSize, info.Size())
+	}
+
+	// The manifest describes the output file.
+	m, err := verifyImageFile(b.OutputPath, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, m.Name, "myapp")
+		assert.NotEqual(t, m.ImageID, "")
+		assert.Equal(t, m.ContextSHA256, b.ContextSHA256)
+		assert.Equal(t, m.BuiltAt, time.Unix(1400000000, 0).UTC())
+	}
+
+	// The image was removed afterwards.
+	_, err = client.InspectImage("myapp")
+	assert.Equal(t, err, docker.ErrNoSuchImage)
+
+	// Building a missing image fails.
+	b.Name = "other"
+	b.Context.DockerfilePath = filepath.Join(root, "Missing")
+	err = b.Run(conn)
+	assert.Error(t, err)
+}
+
+func TestImageBuildRunFailure(t *testing.T) {
+	t.Parallel()
+
+	server := newTestServer(t)
+	defer server.Stop()
+	server.CustomHandler("/images/myapp/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	}))
+
+	conn := newTestConn(t, server.URL())
+	client := conn.Client
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":   "FROM busybox",
+		"myapp.tar.gz": "old image",
+	})
+	defer os.RemoveAll(root)
+
+	b := &imageBuild{
+		Context: &contextOptions{
+			DockerfilePath: filepath.Join(root, "Dockerfile"),
+			RootPath:       root,
+		},
+		Name:        "myapp",
+		Tags:        []string{"myapp:latest"},
+		OutputPath:  filepath.Join(root, "myapp.tar.gz"),
+		Compression: "gzip",
+		RmAfter:     true,
+		Force:       true,
+	}
+	err := b.Run(conn)
+	assert.Error(t, err)
+
+	// The old output file is left alone, and there's no temporary file.
+	data, err := ioutil.ReadFile(b.OutputPath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "old image")
+
+	names, err := filepath.Glob(filepath.Join(root, ".myapp.tar.gz.tmp*"))
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	// The image was still removed.
+	_, err = client.InspectImage("myapp")
+	assert.Equal(t, err, docker.ErrNoSuchImage)
+}
+
+// Not parallel, since it changes the working directory.
+func TestImageBuildRelativeOutput(t *testing.T) {
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+		".env":       "",
+	})
+	defer os.RemoveAll(root)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Error getting working directory: %s", err)
+	}
+	if err = os.Chdir(root); err != nil {
+		t.Fatalf("Error changing directory: %s", err)
+	}
+	defer os.Chdir(cwd)
+
+	// Record what's in the context, and then fail the build.
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	server := newTestServer(t)
+	defer server.Stop()
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			mu.Lock()
+			names = append(names, header.Name)
+			mu.Unlock()
+		}
+		http.Error(w, "build failed", http.StatusInternalServerError)
+	}))
+
+	b := &imageBuild{
+		Context: &contextOptions{
+			DockerfilePath: filepath.Join(root, "Dockerfile"),
+			RootPath:       root,
+			IncludeHidden:  true,
+		},
+		Name:       "myapp",
+		OutputPath: "myapp.image",
+		Force:      true,
+	}
+	assert.Error(t, b.Run(newTestConn(t, server.URL())))
+
+	// The half-written output file isn't part of the context.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, contains(names, ".env"))
+	for _, name := range names {
+		assert.False(t, strings.HasPrefix(name, ".myapp.image.tmp"), "%s is in the context", name)
+	}
+}
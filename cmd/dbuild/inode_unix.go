@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns an identifier for the file's inode, and whether it has more than
+// one hard link.
+func fileInode(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+
+	id := fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+	return id, stat.Nlink > 1
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// Hard links aren't detected on Windows, so every file is written in full.
+func fileInode(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
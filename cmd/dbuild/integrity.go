@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An integrityManifest describes an exported image file, so that it can be
+// checked after it's been copied somewhere else.
+type integrityManifest struct {
+	ImageID       string    `json:"image_id"`
+	Name          string    `json:"name"`
+	Tags          []string  `json:"tags,omitempty"`
+	BuiltAt       time.Time `json:"built_at"`
+	ContextSHA256 string    `json:"context_sha256"`
+	OutputFile    string    `json:"output_file"`
+	OutputSHA256  string    `json:"output_sha256"`
+	OutputSize    int64     `json:"output_size"`
+}
+
+// Returns where the integrity manifest for an output file is kept.  Its
+// signature, if any, is kept next to it, with a ".sig" extension.
+func integrityPath(outputPath string) string {
+	return outputPath + ".manifest.json"
+}
+
+// Reads an ed25519 private key from a PEM file in PKCS #8 format, such as
+// the ones made by "openssl genpkey -algorithm ed25519".
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	ret, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return ret, nil
+}
+
+// Reads an ed25519 public key from a PEM file in PKIX format, such as the
+// ones made by "openssl pkey -pubout".
+func readVerifyKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	ret, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return ret, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s doesn't contain a PEM-encoded %s", path, strings.ToLower(blockType))
+	}
+	return block.Bytes, nil
+}
+
+// Writes the integrity manifest for an output file, and signs it with the
+// given key, if there is one.
+func writeIntegrity(outputPath string, m *integrityManifest, key ed25519.PrivateKey) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	path := integrityPath(outputPath)
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+
+	// An old signature would no longer match.
+	if key == nil {
+		err = os.Remove(path + ".sig")
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return ioutil.WriteFile(path+".sig", []byte(sig+"\n"), 0644)
+}
+
+// Checks an output file against its integrity manifest.  If a key is given,
+// the manifest must have been signed with it.
+func verifyImageFile(outputPath string, key ed25519.PublicKey) (*integrityManifest, error) {
+	path := integrityPath(outputPath)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest: %s", err)
+	}
+
+	sig, err := ioutil.ReadFile(path + ".sig")
+	switch {
+	case err == nil && key == nil:
+		return nil, fmt.Errorf("%s is signed, but no key was given to check it with", path)
+	case os.IsNotExist(err) && key != nil:
+		return nil, fmt.Errorf("%s isn't signed", path)
+	case err != nil && !os.IsNotExist(err):
+		return nil, fmt.Errorf("Error reading signature: %s", err)
+	}
+
+	if key != nil {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signature in %s.sig: %s", path, err)
+		}
+		if !ed25519.Verify(key, data, decoded) {
+			return nil, fmt.Errorf("Signature of %s doesn't match", path)
+		}
+	}
+
+	m := &integrityManifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	if m.OutputFile != filepath.Base(outputPath) {
+		return nil, fmt.Errorf("%s is for %s, not %s", path, m.OutputFile, filepath.Base(outputPath))
+	}
+
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", outputPath, err)
+	}
+	if n != m.OutputSize {
+		return nil, fmt.Errorf("%s is %d bytes, but should be %d", outputPath, n, m.OutputSize)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != m.OutputSHA256 {
+		return nil, fmt.Errorf("%s has SHA-256 %s, but should have %s", outputPath, sum, m.OutputSHA256)
+	}
+
+	return m, nil
+}
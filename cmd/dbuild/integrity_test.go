@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Writes a new key pair to the given directory, returning the paths to the
+// private and public keys.
+func writeTestKeys(t *testing.T, dir, name string) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("Error encoding private key: %s", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %s", err)
+	}
+
+	privatePath := filepath.Join(dir, name+".pem")
+	publicPath := filepath.Join(dir, name+".pub")
+	ioutil.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+	return privatePath, publicPath
+}
+
+func TestIntegrity(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dbuild-integrity")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	privatePath, publicPath := writeTestKeys(t, dir, "key")
+	_, otherPath := writeTestKeys(t, dir, "other")
+
+	signKey, err := readSigningKey(privatePath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	key, err := readVerifyKey(publicPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherKey, err := readVerifyKey(otherPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The keys are in different formats.
+	_, err = readSigningKey(publicPath)
+	assert.Error(t, err)
+
+	outputPath := filepath.Join(dir, "myapp.image")
+	ioutil.WriteFile(outputPath, []byte("image"), 0644)
+
+	m := &integrityManifest{
+		ImageID:    "abc123",
+		Name:       "myapp",
+		BuiltAt:    time.Unix(1400000000, 0).UTC(),
+		OutputFile: "myapp.image",
+		OutputSize: 5,
+		// SHA-256 of "image"
+		OutputSHA256: "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d",
+	}
+
+	// Unsigned manifests only need a matching file.
+	assert.NoError(t, writeIntegrity(outputPath, m, nil))
+	verified, err := verifyImageFile(outputPath, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, verified, m)
+	}
+	_, err = verifyImageFile(outputPath, key)
+	assert.Error(t, err)
+
+	// Signed ones need the right key, too.
+	assert.NoError(t, writeIntegrity(outputPath, m, signKey))
+	_, err = verifyImageFile(outputPath, key)
+	assert.NoError(t, err)
+	_, err = verifyImageFile(outputPath, otherKey)
+	assert.Error(t, err)
+	_, err = verifyImageFile(outputPath, nil)
+	assert.Error(t, err)
+
+	// Changing the manifest breaks the signature.
+	data, _ := ioutil.ReadFile(integrityPath(outputPath))
+	data[len(data)-2] = ' '
+	ioutil.WriteFile(integrityPath(outputPath), data, 0644)
+	_, err = verifyImageFile(outputPath, key)
+	assert.Error(t, err)
+
+	// As does changing the file.
+	assert.NoError(t, writeIntegrity(outputPath, m, signKey))
+	ioutil.WriteFile(outputPath, []byte("imagf"), 0644)
+	_, err = verifyImageFile(outputPath, key)
+	assert.Error(t, err)
+}
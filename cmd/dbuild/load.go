@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/log"
+)
+
+// How often to report how much has been sent to each host.
+const loadProgressInterval = 5 * time.Second
+
+// How long a host may take to accept each write before it's given up on.
+const loadStallTimeout = time.Minute
+
+// An imageLoader loads an image into other Docker hosts while it's being
+// exported.  Each host is sent everything written to the loader.
+type imageLoader struct {
+	prefix       string
+	targets      []*loadTarget
+	stallTimeout time.Duration
+}
+
+type loadTarget struct {
+	endpoint string
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+	done     chan error
+
+	// Cancels the load request, and the error to report once it has been
+	// cancelled because the host stalled.
+	cancel  context.CancelFunc
+	stalled error
+
+	// The number of bytes sent so far, and when that was last reported.
+	sent       int64
+	lastReport time.Time
+
+	// Set once a write fails, after which nothing more is sent.
+	err error
+}
+
+// Starts loading an image into each of the given Docker hosts.
+func startLoads(hosts []*dockerconn.Conn, prefix string) *imageLoader {
+	l := &imageLoader{prefix: prefix, stallTimeout: loadStallTimeout}
+
+	for _, conn := range hosts {
+		t := &loadTarget{
+			endpoint:   conn.Endpoint,
+			done:       make(chan error, 1),
+			lastReport: time.Now(),
+		}
+		l.targets = append(l.targets, t)
+
+		conn := conn
+		log.Infof("%sLoading image into %s...", prefix, conn.Endpoint)
+		pr, pw := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		t.pr, t.pw, t.cancel = pr, pw, cancel
+		go func() {
+			err := loadImage(ctx, conn, pr)
+			cancel()
+
+			// If the load stops early, writes to it mustn't block.
+			pr.CloseWithError(fmt.Errorf("load stopped"))
+			t.done <- err
+		}()
+	}
+
+	return l
+}
+
+// Write sends the data to every host that's still loading.  It never fails,
+// so that a failure with one host doesn't stop the others, and a host that
+// stalls is dropped, rather than holding up the rest.
+func (l *imageLoader) Write(p []byte) (int, error) {
+	var (
+		active   []*loadTarget
+		finished []chan struct{}
+	)
+	for _, t := range l.targets {
+		if t.err != nil {
+			continue
+		}
+
+		done := make(chan struct{})
+		active = append(active, t)
+		finished = append(finished, done)
+		go func(t *loadTarget) {
+			defer close(done)
+			t.write(p, l.prefix)
+		}(t)
+	}
+
+	timer := time.NewTimer(l.stallTimeout)
+	defer timer.Stop()
+	expired := false
+
+	for i, t := range active {
+		if !expired {
+			select {
+			case <-finished[i]:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+
+		// Closing the pipe makes the write return, and cancelling the
+		// request stops waiting for the host to respond.
+		select {
+		case <-finished[i]:
+		default:
+			t.stalled = fmt.Errorf("Host stalled for more than %s", l.stallTimeout)
+			t.pr.CloseWithError(t.stalled)
+			t.cancel()
+			<-finished[i]
+		}
+	}
+
+	return len(p), nil
+}
+
+func (t *loadTarget) write(p []byte, prefix string) {
+	n, err := t.pw.Write(p)
+	t.sent += int64(n)
+	if err != nil {
+		t.err = err
+		return
+	}
+
+	if time.Since(t.lastReport) >= loadProgressInterval {
+		log.Infof("%sSent %d bytes to %s", prefix, t.sent, t.endpoint)
+		t.lastReport = time.Now()
+	}
+}
+
+// Sends an image to the host's load endpoint.  Unlike go-dockerclient's
+// LoadImage, the request can be cancelled while waiting for a response.
+func loadImage(ctx context.Context, conn *dockerconn.Conn, r io.Reader) error {
+	req, err := http.NewRequest("POST", conn.URL("/images/load"), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := conn.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("API error (%d): %s", resp.StatusCode, body)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// Finish waits for every load to finish, and returns the hosts that the
+// image couldn't be loaded into.  If err is non-nil, the image couldn't be
+// exported, and the loads are abandoned.
+func (l *imageLoader) Finish(err error) []string {
+	var failed []string
+
+	for _, t := range l.targets {
+		if t.pw != nil {
+			if err != nil {
+				t.pw.CloseWithError(err)
+			} else {
+				t.pw.Close()
+			}
+		}
+
+		loadErr := <-t.done
+		if t.stalled != nil {
+			loadErr = t.stalled
+		}
+		if loadErr == nil && t.err != nil {
+			loadErr = t.err
+		}
+		if loadErr == nil && err != nil {
+			loadErr = err
+		}
+
+		if loadErr != nil {
+			log.Errorf("%sError loading image into %s: %s", l.prefix, t.endpoint, loadErr)
+			failed = append(failed, t.endpoint)
+			continue
+		}
+		log.Infof("%sLoaded image into %s (%d bytes)", l.prefix, t.endpoint, t.sent)
+	}
+
+	return failed
+}
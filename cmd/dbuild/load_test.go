@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) *dtesting.DockerServer {
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	return server
+}
+
+func newTestConn(t *testing.T, endpoint string) *dockerconn.Conn {
+	conn, err := dockerconn.New(dockerconn.Options{Endpoint: endpoint})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+	return conn
+}
+
+func TestImageBuildLoadInto(t *testing.T) {
+	t.Parallel()
+
+	server := newTestServer(t)
+	defer server.Stop()
+	server.CustomHandler("/images/myapp/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "image data")
+	}))
+
+	// One host that loads the image, and one that fails to.
+	var (
+		mu     sync.Mutex
+		loaded string
+	)
+	good := newTestServer(t)
+	defer good.Stop()
+	good.CustomHandler("/images/load", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		loaded = string(data)
+		mu.Unlock()
+	}))
+
+	bad := newTestServer(t)
+	defer bad.Stop()
+	bad.CustomHandler("/images/load", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	}))
+
+	conn := newTestConn(t, server.URL())
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+	})
+	defer os.RemoveAll(root)
+
+	b := &imageBuild{
+		Context: &contextOptions{
+			DockerfilePath: filepath.Join(root, "Dockerfile"),
+			RootPath:       root,
+		},
+		Name:       "myapp",
+		OutputPath: filepath.Join(root, "myapp.tar"),
+		LoadInto:   []*dockerconn.Conn{newTestConn(t, good.URL()), newTestConn(t, bad.URL())},
+	}
+	err := b.Run(conn)
+	if assert.Error(t, err) {
+		assert.Equal(t, err.Error(), "Failed to load into: "+bad.URL())
+	}
+
+	// The failure with one host doesn't affect the output file, or the
+	// other host.
+	data, err := ioutil.ReadFile(b.OutputPath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "image data")
+
+	mu.Lock()
+	assert.Equal(t, loaded, "image data")
+	mu.Unlock()
+}
+
+func TestImageLoaderStall(t *testing.T) {
+	t.Parallel()
+
+	// One host that loads everything, and one that never reads anything.
+	var (
+		mu     sync.Mutex
+		loaded int
+	)
+	good := newTestServer(t)
+	defer good.Stop()
+	good.CustomHandler("/images/load", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		mu.Lock()
+		loaded = int(n)
+		mu.Unlock()
+	}))
+
+	stalled := newTestServer(t)
+	defer stalled.Stop()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	stalled.CustomHandler("/images/load", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+
+	l := startLoads([]*dockerconn.Conn{newTestConn(t, good.URL()), newTestConn(t, stalled.URL())}, "")
+	l.stallTimeout = 100 * time.Millisecond
+
+	// Far more than can be buffered on the way to the stalled host.
+	chunk := make([]byte, 32<<10)
+	for i := 0; i < 1024; i++ {
+		l.Write(chunk)
+	}
+
+	assert.Equal(t, l.Finish(nil), []string{stalled.URL()})
+	mu.Lock()
+	assert.Equal(t, loaded, 1024*len(chunk))
+	mu.Unlock()
+}
@@ -1,30 +1,74 @@
 package main
 
 import (
-	"archive/tar"
+	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/exitcode"
 	"github.com/andrew-d/docker-tools/log"
-	"github.com/fsouza/go-dockerclient"
 	flag "github.com/ogier/pflag"
 )
 
 var (
-	flagNoCache   bool
-	flagRm        bool
-	flagForceRm   bool
-	flagRmAfter   bool
-	flagEndpoint  string
-	flagImageName string
+	flagNoCache    bool
+	flagRm         bool
+	flagForceRm    bool
+	flagRmAfter    bool
+	flagDocker     dockerconn.Options
+	flagImageName  string
+	flagIgnoreFile string
+
+	flagExclude       stringList
+	flagInclude       stringList
+	flagIncludeHidden bool
+	flagListContext   bool
+
+	flagNormalizeOwner bool
+	flagReproducible   bool
+
+	flagCompress      string
+	flagCompressLevel int
+
+	flagStream   bool
+	flagBuildLog string
+
+	flagTags stringList
+	flagPush bool
+
+	flagManifest string
+	flagJobs     int
+
+	flagForce    bool
+	flagCacheDir string
+
+	flagSquash   bool
+	flagLoadInto stringList
+
+	flagIntegrity bool
+	flagSignKey   string
+
+	flagTemplate   bool
+	flagVars       stringList
+	flagVarsFile   string
+	flagRenderOnly bool
+
+	flagAdds        stringList
+	flagAddOverride bool
+
+	flagMaxContextSize string
+	flagShowLargest    int
 )
 
 func init() {
+	flagDocker.AddFlags(flag.CommandLine)
 	flag.BoolVar(&flagNoCache, "no-cache", false,
 		"Do not use cache when building the image")
 	flag.BoolVar(&flagRm, "rm", false,
@@ -33,253 +77,468 @@ func init() {
 		"Always remove intermediate containers, even after unsuccessful builds")
 	flag.BoolVar(&flagRmAfter, "rm-after", false,
 		"Remove the image from Docker after it's built and exported")
-	flag.StringVarP(&flagEndpoint, "endpoint", "e", "unix:///var/run/docker.sock",
-		"How to connect to the Docker service")
 	flag.StringVarP(&flagImageName, "name", "n", "",
 		"The name to give the built image (default: randomly generated)")
+	flag.StringVar(&flagIgnoreFile, "ignore-file", "",
+		"A .dockerignore file listing paths to leave out of the build context (default: <root path>/.dockerignore)")
+	flag.Var(&flagExclude, "exclude",
+		"Leave paths matching this pattern out of the build context (may be repeated)")
+	flag.Var(&flagInclude, "include",
+		"Only add files matching this pattern to the build context (may be repeated)")
+	flag.BoolVar(&flagIncludeHidden, "include-hidden", false,
+		"Add files and directories whose names start with '.' to the build context")
+	flag.BoolVar(&flagListContext, "list-context", false,
+		"Print the files that would be sent in the build context, and exit")
+	flag.BoolVar(&flagNormalizeOwner, "normalize-owner", false,
+		"Make every file in the build context owned by root (uid and gid 0)")
+	flag.BoolVar(&flagReproducible, "reproducible", false,
+		"Make the build context depend only on file names and contents (mtimes are clamped to $SOURCE_DATE_EPOCH)")
+	flag.StringVar(&flagCompress, "compress", "",
+		"Compress the output file with gzip, bzip2, xz or zstd, or 'none' (default: inferred from the output file's extension)")
+	flag.IntVar(&flagCompressLevel, "compress-level", 0,
+		"The compression level to use (default: the format's own default)")
+	flag.BoolVar(&flagStream, "stream", false,
+		"Send the build context to Docker while it's being written, rather than writing it to a temporary file first")
+	flag.StringVar(&flagBuildLog, "build-log", "",
+		"Save the build's output to this file")
+	flag.Var(&flagTags, "tag",
+		"Tag the built image with this name (may be repeated)")
+	flag.BoolVar(&flagPush, "push", false,
+		"Push each tag after building, using the credentials in the Docker config file")
+	flag.StringVarP(&flagManifest, "file", "f", "",
+		"Build every image listed in this manifest file")
+	flag.IntVarP(&flagJobs, "jobs", "j", runtime.NumCPU(),
+		"The number of images from a manifest to build at once")
+	flag.BoolVar(&flagForce, "force", false,
+		"Build even if nothing has changed since the output file was last built")
+	flag.StringVar(&flagCacheDir, "cache-dir", "",
+		"Keep records of previous builds in this directory (default: next to each output file, with a .dbuild extension)")
+	flag.BoolVar(&flagSquash, "squash", false,
+		"Flatten the built image into a single layer, keeping its config")
+	flag.Var(&flagLoadInto, "load-into",
+		"Load the built image into the Docker host at this endpoint (may be repeated)")
+	flag.BoolVar(&flagIntegrity, "integrity", false,
+		"Write a manifest describing the output file next to it, for 'dbuild verify' to check")
+	flag.StringVar(&flagSignKey, "sign-key", "",
+		"Sign the integrity manifest with the ed25519 private key in this PEM file (implies --integrity)")
+	flag.BoolVar(&flagTemplate, "template", false,
+		"Render the Dockerfile as a Go template, filled from the environment, --vars-file and --var")
+	flag.Var(&flagVars, "var",
+		"Set a KEY=VALUE variable for the Dockerfile template (may be repeated; implies --template)")
+	flag.StringVar(&flagVarsFile, "vars-file", "",
+		"Read KEY=VALUE variables for the Dockerfile template from this file (implies --template)")
+	flag.BoolVar(&flagRenderOnly, "render-only", false,
+		"Print the rendered Dockerfile template, and exit")
+	flag.Var(&flagAdds, "add",
+		"Add a file or directory from outside the root to the build context, as <source>:<destination> (may be repeated)")
+	flag.BoolVar(&flagAddOverride, "add-override", false,
+		"Let --add replace files in the root, rather than that being an error")
+	flag.StringVar(&flagMaxContextSize, "max-context-size", "",
+		"Fail before sending a build context larger than this, such as 500M or 2G")
+	flag.IntVar(&flagShowLargest, "show-largest", 5,
+		"The number of the build context's largest files and directories to show")
 }
 
 func usage() {
 	fmt.Println(strings.TrimSpace(`
-Usage: dbuild [options] <Dockerfile> <root path> <output file>
+Usage: dbuild [options] <Dockerfile> <root> <output file>
+       dbuild --list-context [options] <Dockerfile> <root>
+       dbuild --render-only [options] <Dockerfile>
+       dbuild -f <manifest> [options]
+       dbuild verify [--key <public key>] <output file>
 
 Builds a Docker image from the given Dockerfile, with the root of the build
 context at the given root path.  The built image is then exported into the
 given output file.
 
+The root can also be a tar file (which may be gzipped), a git repository and
+the ref to build ("path/to/repo#ref"), or "-" to read a tar file from stdin.
+
+With -f, builds all of the images listed in the given manifest file, in
+order of their dependencies on each other.
+
+The verify command checks an output file against its integrity manifest,
+and the manifest's signature against the given public key.
+
+Exit codes:
+    0   Success.
+    1   The build (or whatever else was asked for) failed.
+    2   Invalid arguments.
+    3   Invalid options, manifest or inputs.
+    4   Couldn't connect to Docker.
+    5   Partial success: the image was built, but some tags, pushes or
+        --load-into hosts failed, or only some of a manifest's images
+        were built.
+
 Options:`))
 	flag.PrintDefaults()
-	os.Exit(1)
 }
 
 func main() {
+	err := runMain()
+	if err == errUsage {
+		usage()
+	} else if err != nil {
+		log.Errorf("%s", err)
+	}
+	os.Exit(exitcode.Of(err))
+}
+
+// Does whatever the command line asks for.
+func runMain() error {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		return runVerify(os.Args[2:])
+	}
+
 	flag.Parse()
 
-	if flag.NArg() < 3 {
-		usage()
+	if len(flagManifest) > 0 {
+		if flag.NArg() > 0 {
+			return errUsage
+		}
+		return runManifestFile(flagManifest)
 	}
 
-	dockerfilePath, err := filepath.Abs(flag.Arg(0))
-	if err != nil {
-		log.Errorf("Error finding absolute path (1): %s", err)
-		return
+	if flagRenderOnly {
+		if flag.NArg() != 1 {
+			return errUsage
+		}
+		return runRender(flag.Arg(0))
 	}
 
-	rootPath, err := filepath.Abs(flag.Arg(1))
-	if err != nil {
-		log.Errorf("Error finding absolute path (2): %s", err)
-		return
+	if flag.NArg() < 3 && !(flagListContext && flag.NArg() == 2) {
+		return errUsage
 	}
 
-	outputPath := flag.Arg(2)
+	return run()
+}
 
-	log.Infof("Started")
+// Does the build.
+func run() error {
+	dockerfilePath, err := filepath.Abs(flag.Arg(0))
+	if err != nil {
+		return fmt.Errorf("Error finding absolute path (1): %s", err)
+	}
 
-	client, err := docker.NewClient(flagEndpoint)
+	rootPath, cleanup, err := prepareRoot(flag.Arg(1), os.Stdin)
 	if err != nil {
-		log.Errorf("Error creating Docker client: %s", err)
-		return
+		return exitcode.With(exitConfig, err)
 	}
+	defer cleanup()
 
-	err = client.Ping()
+	ctxOpts, err := newContextOptions(dockerfilePath, rootPath)
 	if err != nil {
-		log.Errorf("Error pinging Docker client: %s", err)
-		return
+		return exitcode.With(exitConfig, err)
+	}
+
+	if flagListContext {
+		return listContext(os.Stdout, ctxOpts)
 	}
 
-	log.Infof("Connected to Docker client")
+	// Get the image name.
+	name := flagImageName
+	if len(name) == 0 {
+		name = randString(20)
+	}
 
-	// Create the output buffer.
-	outf, err := os.Create(outputPath)
-	if err != nil {
-		log.Errorf("Error creating output file: %s", err)
-		return
+	if flagPush && len(flagTags) == 0 {
+		return exitcode.Errorf(exitUsage, "--push requires at least one --tag")
 	}
-	defer outf.Close()
 
-	// Create our build context tar file.
-	buildctx, err := ioutil.TempFile("", "dbuild-ctx")
+	b, err := newImageBuild(ctxOpts, name, flagTags, flag.Arg(2), flagCompress, flagCompressLevel)
 	if err != nil {
-		log.Errorf("Error creating temporary build context file: %s", err)
-		return
+		return exitcode.With(exitConfig, err)
 	}
-	defer buildctx.Close()
+	b.BuildLog = flagBuildLog
+	b.GeneratedName = len(flagImageName) == 0
 
-	tr := tar.NewWriter(buildctx)
+	log.Infof("Started")
 
-	// Write the Dockerfile into the build context
-	dockerfile, err := os.Open(dockerfilePath)
+	conn, err := connect()
 	if err != nil {
-		log.Errorf("Error opening Dockerfile: %s", err)
-		return
+		return err
 	}
 
-	err = writeFileTo(tr, dockerfile, "Dockerfile")
+	err = b.Run(conn)
 	if err != nil {
-		log.Errorf("Error writing Dockerfile to build context: %s", err)
-		return
+		return err
 	}
 
-	// Recursively search the root for other files and add those.
-	log.Infof("Adding files to build context...")
-
-	rootDockerfilePath := filepath.Join(rootPath, "Dockerfile")
-	err = filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-		// If there's an error, we just return it and abort the walk.
-		if err != nil {
-			return err
-		}
-
-		// Ignore paths that start with '.'
-		if len(path) > 0 && path[0] == '.' {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
+	log.Infof("Completed successfully")
+	return nil
+}
 
-		// Just descend into directories.
-		if info.IsDir() {
-			return nil
-		}
+// Builds all the images in a manifest.  If only some of them are built, it's
+// a partial success.
+func runManifestFile(path string) error {
+	entries, err := readManifest(path)
+	if err != nil {
+		return exitcode.With(exitConfig, err)
+	}
 
-		// We skip this file if the path is the same as our Dockerfile, and if
-		// it's in the root directory.  This is to avoid having two Dockerfiles
-		// in the root.
-		if path == rootDockerfilePath {
-			return nil
+	// Check all the images' options before building any of them.
+	builds := make(map[*manifestEntry]*imageBuild)
+	for _, e := range entries {
+		ctxOpts, err := newContextOptions(e.Dockerfile, e.Root)
+		if err == nil {
+			builds[e], err = newImageBuild(ctxOpts, e.Name, e.Tags, e.Output, e.Compress, e.CompressLevel)
 		}
-
-		// Find the path relative to the root.
-		rel, err := filepath.Rel(rootPath, path)
 		if err != nil {
-			return err
+			return exitcode.Errorf(exitConfig, "Image %s: %s", e.Key, err)
 		}
 
-		// Open the file.
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
+		builds[e].BuildLog = e.BuildLog
+		builds[e].Prefix = e.Key + ": "
+		e.Rendered = ctxOpts.Dockerfile
+	}
 
-		// This is the VT100 escape sequence for "clear line".
-		fmt.Printf("\r\033[2KAdding file: %s", rel)
+	// Only rendered Dockerfiles show which images they're built from.
+	if err = resolveDependencies(entries); err != nil {
+		return exitcode.With(exitConfig, err)
+	}
 
-		// Add this file to the TAR file.
-		err = writeFileTo(tr, f, rel)
+	log.Infof("Started")
 
-		// TODO: ensure that the file we're adding isn't our Dockerfile?
+	conn, err := connect()
+	if err != nil {
+		return err
+	}
 
-		// log.Infof(path)
+	results := runManifest(entries, flagJobs, func(e *manifestEntry) error {
+		// An image has to be rebuilt if anything it's built from was.
+		for _, dep := range e.Dependencies {
+			if !builds[dep].Unchanged {
+				builds[e].Force = true
+			}
+		}
 
+		log.Infof("%s: Starting build", e.Key)
+		err := builds[e].Run(conn)
+		if err != nil {
+			log.Errorf("%s: %s", e.Key, err)
+		}
 		return err
 	})
 
-	// Clear line
-	fmt.Printf("\r\033[2K")
-	log.Infof("Finished adding build context")
+	fmt.Println()
+	printManifestResults(os.Stdout, results)
 
-	err = tr.Close()
+	built, partial := 0, false
+	for _, r := range results {
+		if r.Status == statusOK {
+			built++
+		}
+		if exitcode.Of(r.Err) == exitPartial {
+			partial = true
+		}
+	}
+	if built == len(results) {
+		return nil
+	}
+
+	code := exitFailure
+	if built > 0 || partial {
+		code = exitPartial
+	}
+	return exitcode.Errorf(code, "Built %d of %d images", built, len(results))
+}
+
+// Returns the options for a build context, from the command-line flags.
+func newContextOptions(dockerfilePath, rootPath string) (*contextOptions, error) {
+	// Find the files to ignore.  It's only an error for the ignore file to
+	// be missing if it was explicitly given.
+	ignorePath := flagIgnoreFile
+	if len(ignorePath) == 0 {
+		ignorePath = filepath.Join(rootPath, ".dockerignore")
+	} else if _, err := os.Stat(ignorePath); err != nil {
+		return nil, fmt.Errorf("Error reading ignore file: %s", err)
+	}
+	ignore, err := ReadIgnoreFile(ignorePath)
 	if err != nil {
-		log.Errorf("Error finalizing build context: %s", err)
-		return
+		return nil, fmt.Errorf("Error reading ignore file: %s", err)
 	}
 
-	// Need to rewind our tar file handle to the beginning.
-	_, err = buildctx.Seek(0, 0)
+	exclude, err := NewIgnoreMatcher(flagExclude)
 	if err != nil {
-		log.Errorf("Error seeking to beginning of build context: %s", err)
-		return
+		return nil, fmt.Errorf("Error parsing --exclude: %s", err)
 	}
 
-	// Get the image name.
-	if len(flagImageName) == 0 {
-		flagImageName = randString(20)
+	ctxOpts := &contextOptions{
+		DockerfilePath: dockerfilePath,
+		RootPath:       rootPath,
+		Ignore:         ignore,
+		Exclude:        exclude,
+		IncludeHidden:  flagIncludeHidden,
+		NormalizeOwner: flagNormalizeOwner,
+		Reproducible:   flagReproducible,
+		OverrideAdds:   flagAddOverride,
+	}
+	for _, arg := range flagAdds {
+		add, err := parseAdd(arg)
+		if err != nil {
+			return nil, err
+		}
+		ctxOpts.Adds = append(ctxOpts.Adds, add)
+	}
+	if len(flagInclude) > 0 {
+		ctxOpts.Include, err = NewIgnoreMatcher(flagInclude)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing --include: %s", err)
+		}
+	}
+	if useTemplate() {
+		ctxOpts.Dockerfile, err = renderFromFlags(dockerfilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); flagReproducible && len(epoch) > 0 {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SOURCE_DATE_EPOCH %q: %s", epoch, err)
+		}
+		ctxOpts.SourceDateEpoch = time.Unix(secs, 0)
 	}
-	log.Infof("Using image name: %s", flagImageName)
 
-	// Set up build options.  Note that the escape at the end resets the
-	// terminal color.
-	output := NewLineStreamer(os.Stdout, "   [build] ", "\x1b[0m")
-	opts := docker.BuildImageOptions{
-		Name:         flagImageName,
-		InputStream:  buildctx,
-		OutputStream: output,
+	return ctxOpts, nil
+}
 
-		// From program options.
-		NoCache:             flagNoCache,
-		RmTmpContainer:      flagRm,
-		ForceRmTmpContainer: flagForceRm,
+// Sets up the build of a single image, checking its options and taking the
+// rest from the command-line flags.
+func newImageBuild(ctxOpts *contextOptions, name string, tags []string, outputPath, compress string, compressLevel int) (*imageBuild, error) {
+	b := &imageBuild{
+		Context:       ctxOpts,
+		Name:          name,
+		Tags:          tags,
+		OutputPath:    outputPath,
+		CompressLevel: compressLevel,
+		Push:          flagPush && len(tags) > 0,
+		NoCache:       flagNoCache,
+		Rm:            flagRm,
+		ForceRm:       flagForceRm,
+		RmAfter:       flagRmAfter,
+		Stream:        flagStream,
+		Squash:        flagSquash,
+		ShowLargest:   flagShowLargest,
+		Integrity:     flagIntegrity,
+		Force:         flagForce,
+		CacheDir:      flagCacheDir,
 	}
 
-	// Send everything off for building
-	log.Infof("Starting to build image, please wait...")
-	err = client.BuildImage(opts)
-	if err != nil {
-		log.Errorf("Error building image: %s", err)
-		return
+	var err error
+	b.Compression, err = compressionFor(compress, outputPath)
+	if err == nil {
+		err = checkCompression(b.Compression, compressLevel)
 	}
-	log.Infof("Finished building image")
-
-	// Inspect the image to get information.
-	img, err := client.InspectImage(flagImageName)
 	if err != nil {
-		log.Errorf("Error inspecting image: %s", err)
-		return
+		return nil, err
 	}
 
-	log.Infof("Image built (size = %d)", img.Size)
+	if len(flagMaxContextSize) > 0 {
+		b.MaxContextSize, err = parseSize(flagMaxContextSize)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing --max-context-size: %s", err)
+		}
+	}
 
-	// Export the image to our output file.
-	exportOpts := docker.ExportImageOptions{
-		Name:         flagImageName,
-		OutputStream: outf,
+	for _, endpoint := range flagLoadInto {
+		opts := flagDocker
+		opts.Endpoint = endpoint
+		conn, err := dockerconn.New(opts)
+		if err != nil {
+			return nil, fmt.Errorf("Error setting up --load-into %s: %s", endpoint, err)
+		}
+		b.LoadInto = append(b.LoadInto, conn)
 	}
 
-	log.Infof("Exporting built image, please wait...")
-	err = client.ExportImage(exportOpts)
-	if err != nil {
-		log.Errorf("Error exporting image: %s", err)
-		return
+	if len(flagSignKey) > 0 {
+		b.SignKey, err = readSigningKey(flagSignKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading signing key: %s", err)
+		}
 	}
-	log.Infof("Finished exporting")
 
-	// Optionally remove the image.
-	if flagRmAfter {
-		log.Infof("Removing image...")
-		err = client.RemoveImage(flagImageName)
+	if b.Push {
+		b.Auths, err = readDockerAuth(dockerConfigPath())
 		if err != nil {
-			log.Errorf("Error removing image: %s", err)
-			return
+			return nil, fmt.Errorf("Error reading registry credentials: %s", err)
 		}
-		log.Infof("Image removed")
 	}
 
-	log.Infof("Completed successfully")
+	return b, nil
 }
 
-// Write the contents of a file to a TAR file.
-func writeFileTo(tarfile *tar.Writer, f *os.File, name string) error {
-	info, err := f.Stat()
+// Prints the rendered Dockerfile template.
+func runRender(dockerfilePath string) error {
+	data, err := renderFromFlags(dockerfilePath)
 	if err != nil {
-		return err
+		return exitcode.With(exitConfig, err)
 	}
 
-	header, err := tar.FileInfoHeader(info, "")
+	os.Stdout.Write(data)
+	return nil
+}
+
+// Returns whether the Dockerfile should be rendered as a template.
+func useTemplate() bool {
+	return flagTemplate || len(flagVars) > 0 || len(flagVarsFile) > 0 || flagRenderOnly
+}
+
+// Renders a Dockerfile template with the variables from the command line.
+func renderFromFlags(dockerfilePath string) ([]byte, error) {
+	vars, err := templateVars(os.Environ(), flagVarsFile, flagVars)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return renderDockerfile(dockerfilePath, vars)
+}
+
+// Checks an output file against its integrity manifest.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyPath := flags.String("key", "",
+		"The ed25519 public key, in a PEM file, that the manifest must be signed with")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
 	}
 
-	header.Name = name
+	var key ed25519.PublicKey
+	if len(*keyPath) > 0 {
+		var err error
+		key, err = readVerifyKey(*keyPath)
+		if err != nil {
+			return exitcode.Errorf(exitConfig, "Error reading public key: %s", err)
+		}
+	}
 
-	err = tarfile.WriteHeader(header)
+	m, err := verifyImageFile(flags.Arg(0), key)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(tarfile, f)
-	return err
+	if key == nil {
+		log.Warnf("The manifest isn't signed, so only the file's hash was checked")
+	}
+	log.Infof("%s is intact: image %s (%s), built at %s",
+		flags.Arg(0), m.Name, m.ImageID, m.BuiltAt.Format(time.RFC3339))
+	return nil
+}
+
+// Connects to Docker.
+func connect() (*dockerconn.Conn, error) {
+	conn, err := dockerconn.New(flagDocker)
+	if err != nil {
+		return nil, exitcode.With(exitConfig, err)
+	}
+
+	err = conn.Ping()
+	if err != nil {
+		return nil, exitcode.With(exitConnection, err)
+	}
+
+	log.Infof("Connected to Docker at %s", conn.Endpoint)
+	return conn, nil
 }
 
 func randString(n int) string {
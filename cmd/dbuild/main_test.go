@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// When this is set, the test binary runs dbuild itself, so that tests can
+// check the code it exits with.
+const runMainEnv = "DBUILD_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// Runs dbuild with the given arguments, and returns its exit code.
+func runDbuild(t *testing.T, args ...string) int {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	t.Logf("dbuild %v:\n%s", args, out)
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("Error running dbuild: %s", err)
+	}
+	return 0
+}
+
+func TestExitCodes(t *testing.T) {
+	t.Parallel()
+
+	server := newTestServer(t)
+	defer server.Stop()
+	server.CustomHandler("/images/bad/tag", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such repository", http.StatusInternalServerError)
+	}))
+	endpoint := "--endpoint=" + server.URL()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+		"app.js":     "",
+		"manifest.yml": "images:\n" +
+			"  good: {}\n" +
+			"  bad:\n" +
+			"    tags: bad:latest\n",
+	})
+	defer os.RemoveAll(root)
+	dockerfile := filepath.Join(root, "Dockerfile")
+	output := filepath.Join(root, "out.tar")
+
+	for _, c := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{endpoint, "--name=good", dockerfile, root, output}, exitOK},
+		{[]string{"--list-context", dockerfile, root}, exitOK},
+
+		{[]string{dockerfile, root}, exitUsage},
+		{[]string{"--no-such-flag", dockerfile, root, output}, exitUsage},
+		{[]string{"verify"}, exitUsage},
+
+		{[]string{"--compress=rar", dockerfile, root, output}, exitConfig},
+		{[]string{dockerfile, filepath.Join(root, "missing"), output}, exitConfig},
+		{[]string{"-f", filepath.Join(root, "missing.yml")}, exitConfig},
+		{[]string{"--endpoint=tcp://127.0.0.1:1", "--tlsverify", "--tlscacert=" + filepath.Join(root, "missing.pem"),
+			dockerfile, root, output}, exitConfig},
+
+		{[]string{"--endpoint=tcp://127.0.0.1:1", "--ping-retries=0", dockerfile, root, output}, exitConnection},
+
+		{[]string{endpoint, filepath.Join(root, "Missing"), root, output}, exitFailure},
+		{[]string{"verify", filepath.Join(root, "app.js")}, exitFailure},
+
+		{[]string{endpoint, "--name=bad", "--tag=bad:latest", dockerfile, root, output}, exitPartial},
+		{[]string{endpoint, "-f", filepath.Join(root, "manifest.yml")}, exitPartial},
+	} {
+		assert.Equal(t, runDbuild(t, c.args...), c.code, "dbuild %v", c.args)
+	}
+}
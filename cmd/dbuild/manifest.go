@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v1"
+)
+
+// A manifestEntry is a single image in a build manifest.
+type manifestEntry struct {
+	Key string
+
+	Dockerfile    string
+	Root          string
+	Name          string
+	Tags          []string
+	Output        string
+	Compress      string
+	CompressLevel int
+	BuildLog      string
+
+	// The Dockerfile's contents, if it's been rendered from a template.
+	Rendered []byte
+
+	// The entries whose images this one is built from.
+	Dependencies []*manifestEntry
+}
+
+// Reads a build manifest.  Relative paths in the manifest are relative to the
+// directory it's in.
+func readManifest(path string) ([]*manifestEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest: %s", err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("Error finding absolute path: %s", err)
+	}
+
+	return parseManifest(data, dir)
+}
+
+func parseManifest(data []byte, dir string) ([]*manifestEntry, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Error parsing manifest: %s", err)
+	}
+
+	for key := range raw {
+		if key != "images" {
+			return nil, fmt.Errorf("Unknown key in manifest: %s", key)
+		}
+	}
+
+	images, ok := raw["images"].(map[interface{}]interface{})
+	if !ok || len(images) == 0 {
+		return nil, fmt.Errorf("Manifest must have an 'images' map with at least one image")
+	}
+
+	var entries []*manifestEntry
+	for k, v := range images {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid image name in manifest: %+v", k)
+		}
+
+		config, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid config for image %s: expected a map, got %T", key, v)
+		}
+
+		entry, err := parseManifestEntry(key, config, dir)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(entriesByKey(entries))
+	return entries, nil
+}
+
+func parseManifestEntry(key string, config map[interface{}]interface{}, dir string) (*manifestEntry, error) {
+	ret := &manifestEntry{
+		Key:  key,
+		Name: key,
+		Root: ".",
+	}
+
+	for k, val := range config {
+		name, _ := k.(string)
+
+		var err error
+		switch name {
+		case "dockerfile":
+			ret.Dockerfile, err = manifestString(val)
+		case "root":
+			ret.Root, err = manifestString(val)
+		case "name":
+			ret.Name, err = manifestString(val)
+		case "output":
+			ret.Output, err = manifestString(val)
+		case "compress":
+			ret.Compress, err = manifestString(val)
+		case "build-log":
+			ret.BuildLog, err = manifestString(val)
+
+		case "compress-level":
+			var ok bool
+			if ret.CompressLevel, ok = val.(int); !ok {
+				err = fmt.Errorf("expected an integer, got %T", val)
+			}
+
+		case "tags":
+			ret.Tags, err = manifestStringList(val)
+
+		default:
+			return nil, fmt.Errorf("Unknown key in config for image %s: %+v", key, k)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing key '%s' for image %s: %s", name, key, err)
+		}
+	}
+
+	// Make paths relative to the manifest.
+	ret.Root = manifestPath(dir, ret.Root)
+	if len(ret.Dockerfile) == 0 {
+		ret.Dockerfile = filepath.Join(ret.Root, "Dockerfile")
+	} else {
+		ret.Dockerfile = manifestPath(dir, ret.Dockerfile)
+	}
+	if len(ret.Output) > 0 {
+		ret.Output = manifestPath(dir, ret.Output)
+	}
+	if len(ret.BuildLog) > 0 {
+		ret.BuildLog = manifestPath(dir, ret.BuildLog)
+	}
+
+	return ret, nil
+}
+
+func manifestString(val interface{}) (string, error) {
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %T", val)
+	}
+	return s, nil
+}
+
+func manifestStringList(val interface{}) ([]string, error) {
+	if s, ok := val.(string); ok {
+		return []string{s}, nil
+	}
+
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of strings, got %T", val)
+	}
+
+	var ret []string
+	for _, item := range list {
+		s, err := manifestString(item)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func manifestPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
+}
+
+type entriesByKey []*manifestEntry
+
+func (e entriesByKey) Len() int           { return len(e) }
+func (e entriesByKey) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entriesByKey) Less(i, j int) bool { return e[i].Key < e[j].Key }
+
+// Returns the images that a Dockerfile builds FROM, leaving out earlier
+// stages of a multi-stage build.
+func dockerfileBaseImages(r io.Reader) ([]string, error) {
+	var (
+		images []string
+		stages = make(map[string]bool)
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// Skip flags such as --platform.
+		args := fields[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if !stages[strings.ToLower(args[0])] {
+			images = append(images, args[0])
+		}
+		if len(args) >= 3 && strings.EqualFold(args[1], "AS") {
+			stages[strings.ToLower(args[2])] = true
+		}
+	}
+
+	return images, scanner.Err()
+}
+
+// Returns an image name in a canonical "repo:tag" form, so that names can be
+// compared.
+func canonicalImageName(name string) string {
+	repo, tag := parseRepositoryTag(name)
+	return repo + ":" + tag
+}
+
+// Finds which entries are built from the images of others, by looking at
+// the FROM lines in their Dockerfiles (as rendered, if they're templates).
+func resolveDependencies(entries []*manifestEntry) error {
+	builtBy := make(map[string]*manifestEntry)
+	for _, e := range entries {
+		for _, name := range append([]string{e.Name}, e.Tags...) {
+			name = canonicalImageName(name)
+			if other, ok := builtBy[name]; ok && other != e {
+				return fmt.Errorf("Image %s is built by both %s and %s", name, other.Key, e.Key)
+			}
+			builtBy[name] = e
+		}
+	}
+
+	for _, e := range entries {
+		var (
+			bases []string
+			err   error
+		)
+		if e.Rendered != nil {
+			bases, err = dockerfileBaseImages(bytes.NewReader(e.Rendered))
+		} else {
+			var f *os.File
+			f, err = os.Open(e.Dockerfile)
+			if err == nil {
+				bases, err = dockerfileBaseImages(f)
+				f.Close()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading Dockerfile for image %s: %s", e.Key, err)
+		}
+
+		e.Dependencies = nil
+		for _, base := range bases {
+			dep, ok := builtBy[canonicalImageName(base)]
+			if !ok || dep == e || containsEntry(e.Dependencies, dep) {
+				continue
+			}
+			e.Dependencies = append(e.Dependencies, dep)
+		}
+	}
+
+	return checkManifestCycles(entries)
+}
+
+func containsEntry(list []*manifestEntry, e *manifestEntry) bool {
+	for _, item := range list {
+		if item == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if any images depend on each other.
+func checkManifestCycles(entries []*manifestEntry) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[*manifestEntry]int)
+
+	var visit func(e *manifestEntry, path []string) error
+	visit = func(e *manifestEntry, path []string) error {
+		path = append(path, e.Key)
+
+		switch state[e] {
+		case visiting:
+			return fmt.Errorf("Dependency cycle between images: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+
+		state[e] = visiting
+		for _, dep := range e.Dependencies {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[e] = visited
+		return nil
+	}
+
+	for _, e := range entries {
+		if err := visit(e, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	statusOK      = "ok"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// The outcome of building one image from a manifest.
+type manifestResult struct {
+	Entry    *manifestEntry
+	Status   string
+	Err      error
+	Duration time.Duration
+}
+
+// Builds every image in the manifest with the given function, running up to
+// the given number of builds at once.  An image is only built once all the
+// images it depends on have been; if any of them failed, it's skipped.
+func runManifest(entries []*manifestEntry, jobs int, build func(e *manifestEntry) error) []*manifestResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var (
+		results = make(map[*manifestEntry]*manifestResult)
+		started = make(map[*manifestEntry]bool)
+		done    = make(chan *manifestResult)
+		running = 0
+	)
+
+	for len(results) < len(entries) {
+		// Start everything that's ready, and skip everything that can never
+		// be.  Skipping an image may mean its dependents can be skipped, so
+		// we keep going until nothing changes.
+		for changed := true; changed; {
+			changed = false
+
+			for _, e := range entries {
+				if started[e] || running >= jobs {
+					continue
+				}
+
+				ready, failedDep := true, ""
+				for _, dep := range e.Dependencies {
+					r, ok := results[dep]
+					if !ok {
+						ready = false
+						break
+					}
+					if r.Status != statusOK {
+						failedDep = dep.Key
+					}
+				}
+				if !ready {
+					continue
+				}
+
+				started[e] = true
+				changed = true
+
+				if len(failedDep) > 0 {
+					results[e] = &manifestResult{
+						Entry:  e,
+						Status: statusSkipped,
+						Err:    fmt.Errorf("%s was not built", failedDep),
+					}
+					continue
+				}
+
+				running++
+				go func(e *manifestEntry) {
+					start := time.Now()
+					err := build(e)
+
+					r := &manifestResult{Entry: e, Status: statusOK, Err: err}
+					if err != nil {
+						r.Status = statusFailed
+					}
+					r.Duration = time.Since(start)
+					done <- r
+				}(e)
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-done
+		running--
+		results[r.Entry] = r
+	}
+
+	ret := make([]*manifestResult, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, results[e])
+	}
+	return ret
+}
+
+// Prints a table of the results of building a manifest.
+func printManifestResults(out io.Writer, results []*manifestResult) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tSTATUS\tTIME\tDETAILS")
+	for _, r := range results {
+		details := r.Entry.Output
+		if r.Err != nil {
+			details = r.Err.Error()
+		}
+
+		duration := "-"
+		if r.Status != statusSkipped {
+			duration = fmt.Sprintf("%.1fs", r.Duration.Seconds())
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Entry.Key, r.Status, duration, details)
+	}
+	w.Flush()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseManifest(t *testing.T) {
+	t.Parallel()
+
+	entries, err := parseManifest([]byte(`
+images:
+  base:
+    root: base
+    tags: myorg/base:latest
+  app:
+    dockerfile: docker/Dockerfile.app
+    root: .
+    name: myorg/app
+    tags:
+      - myorg/app:1.0
+      - registry.example.com/app
+    output: out/app.tar.gz
+    compress: xz
+    compress-level: 6
+    build-log: logs/app.log
+`), "/src")
+	assert.NoError(t, err)
+
+	if assert.Equal(t, len(entries), 2) {
+		assert.Equal(t, *entries[0], manifestEntry{
+			Key:           "app",
+			Dockerfile:    "/src/docker/Dockerfile.app",
+			Root:          "/src",
+			Name:          "myorg/app",
+			Tags:          []string{"myorg/app:1.0", "registry.example.com/app"},
+			Output:        "/src/out/app.tar.gz",
+			Compress:      "xz",
+			CompressLevel: 6,
+			BuildLog:      "/src/logs/app.log",
+		})
+		assert.Equal(t, *entries[1], manifestEntry{
+			Key:        "base",
+			Dockerfile: "/src/base/Dockerfile",
+			Root:       "/src/base",
+			Name:       "base",
+			Tags:       []string{"myorg/base:latest"},
+		})
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Manifest string
+		Error    string
+	}{
+		{"images: {}", "Manifest must have an 'images' map with at least one image"},
+		{"builds: {}", "Unknown key in manifest: builds"},
+		{"images:\n  app: foo", "Invalid config for image app: expected a map, got string"},
+		{"images:\n  app:\n    bogus: 1", "Unknown key in config for image app: bogus"},
+		{"images:\n  app:\n    tags: {a: b}", "Error parsing key 'tags' for image app: expected a list of strings, got map[interface {}]interface {}"},
+		{"images:\n  app:\n    compress-level: high", "Error parsing key 'compress-level' for image app: expected an integer, got string"},
+	}
+
+	for _, test := range tests {
+		_, err := parseManifest([]byte(test.Manifest), "/src")
+		assert.EqualError(t, err, test.Error, test.Manifest)
+	}
+}
+
+func TestDockerfileBaseImages(t *testing.T) {
+	t.Parallel()
+
+	images, err := dockerfileBaseImages(strings.NewReader(`
+# A multi-stage build.
+FROM golang:1.4 AS build
+RUN go build
+from --platform=linux/amd64 myorg/base
+FROM build
+COPY --from=build /app /app
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, images, []string{"golang:1.4", "myorg/base"})
+}
+
+// Creates a manifest entry whose Dockerfile is built FROM the given image.
+func makeEntry(t *testing.T, dir, key, from string, tags ...string) *manifestEntry {
+	path := filepath.Join(dir, key+".Dockerfile")
+	err := ioutil.WriteFile(path, []byte("FROM "+from+"\nRUN true\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing Dockerfile: %s", err)
+	}
+
+	return &manifestEntry{
+		Key:        key,
+		Name:       key,
+		Tags:       tags,
+		Dockerfile: path,
+	}
+}
+
+func depKeys(e *manifestEntry) []string {
+	keys := []string{}
+	for _, dep := range e.Dependencies {
+		keys = append(keys, dep.Key)
+	}
+	return keys
+}
+
+func TestResolveDependencies(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTree(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	base := makeEntry(t, dir, "base", "busybox", "myorg/base:1.0")
+	app := makeEntry(t, dir, "app", "myorg/base:1.0")
+	worker := makeEntry(t, dir, "worker", "app:latest")
+	tool := makeEntry(t, dir, "tool", "base:2.0")
+
+	err := resolveDependencies([]*manifestEntry{app, base, tool, worker})
+	assert.NoError(t, err)
+	assert.Equal(t, depKeys(base), []string{})
+	assert.Equal(t, depKeys(app), []string{"base"})
+	assert.Equal(t, depKeys(worker), []string{"app"})
+	assert.Equal(t, depKeys(tool), []string{})
+
+	// Cycles and duplicate names are errors.
+	a := makeEntry(t, dir, "a", "c")
+	b := makeEntry(t, dir, "b", "a")
+	c := makeEntry(t, dir, "c", "b")
+	err = resolveDependencies([]*manifestEntry{a, b, c})
+	assert.EqualError(t, err, "Dependency cycle between images: a -> c -> b -> a")
+
+	// Templates are resolved from the rendered Dockerfile.
+	templated := makeEntry(t, dir, "templated", "{{.BASE}}")
+	templated.Rendered = []byte("FROM myorg/base:1.0\n")
+	err = resolveDependencies([]*manifestEntry{base, templated})
+	assert.NoError(t, err)
+	assert.Equal(t, depKeys(templated), []string{"base"})
+
+	dup := makeEntry(t, dir, "dup", "busybox", "myorg/base:1.0")
+	err = resolveDependencies([]*manifestEntry{base, dup})
+	assert.EqualError(t, err, "Image myorg/base:1.0 is built by both base and dup")
+}
+
+func TestRunManifest(t *testing.T) {
+	t.Parallel()
+
+	//   base <- app <- worker
+	//        <- broken <- plugin
+	//   tool
+	base := &manifestEntry{Key: "base"}
+	app := &manifestEntry{Key: "app", Dependencies: []*manifestEntry{base}}
+	worker := &manifestEntry{Key: "worker", Dependencies: []*manifestEntry{app}}
+	broken := &manifestEntry{Key: "broken", Dependencies: []*manifestEntry{base}}
+	plugin := &manifestEntry{Key: "plugin", Dependencies: []*manifestEntry{broken}}
+	tool := &manifestEntry{Key: "tool", Output: "/out/tool.tar"}
+	entries := []*manifestEntry{app, base, broken, plugin, tool, worker}
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	results := runManifest(entries, 1, func(e *manifestEntry) error {
+		mu.Lock()
+		order = append(order, e.Key)
+		mu.Unlock()
+
+		if e == broken {
+			return fmt.Errorf("build failed")
+		}
+		return nil
+	})
+
+	// Everything is built after its dependencies.
+	position := make(map[string]int)
+	for i, key := range order {
+		position[key] = i
+	}
+	assert.Equal(t, len(order), 5)
+	assert.True(t, position["base"] < position["app"])
+	assert.True(t, position["app"] < position["worker"])
+	assert.True(t, position["base"] < position["broken"])
+
+	statuses := []string{}
+	for _, r := range results {
+		statuses = append(statuses, r.Entry.Key+"="+r.Status)
+	}
+	assert.Equal(t, statuses, []string{
+		"app=ok",
+		"base=ok",
+		"broken=failed",
+		"plugin=skipped",
+		"tool=ok",
+		"worker=ok",
+	})
+
+	for _, r := range results {
+		r.Duration = 1500 * time.Millisecond
+	}
+	var buf bytes.Buffer
+	printManifestResults(&buf, results)
+	assert.Equal(t, buf.String(), ""+
+		"IMAGE   STATUS   TIME  DETAILS\n"+
+		"app     ok       1.5s  \n"+
+		"base    ok       1.5s  \n"+
+		"broken  failed   1.5s  build failed\n"+
+		"plugin  skipped  -     broken was not built\n"+
+		"tool    ok       1.5s  /out/tool.tar\n"+
+		"worker  ok       1.5s  \n")
+}
+
+func TestRunManifestParallel(t *testing.T) {
+	t.Parallel()
+
+	entries := []*manifestEntry{{Key: "a"}, {Key: "b"}, {Key: "c"}}
+
+	// With two jobs, two builds run at once, but never three.
+	var (
+		mu          sync.Mutex
+		running     int
+		maxRunning  int
+		bothStarted = make(chan struct{})
+		closeOnce   sync.Once
+	)
+	runManifest(entries, 2, func(e *manifestEntry) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		if running == 2 {
+			closeOnce.Do(func() { close(bothStarted) })
+		}
+		mu.Unlock()
+
+		select {
+		case <-bothStarted:
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	assert.Equal(t, maxRunning, 2)
+}
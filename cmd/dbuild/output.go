@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// An outputFile is written as a temporary file in the same directory as the
+// real one, which it only replaces once it's complete.
+type outputFile struct {
+	*os.File
+
+	path string
+	done bool
+}
+
+func createOutputFile(path string) (*outputFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{File: f, path: path}, nil
+}
+
+// Commit closes the file, and moves it into place.
+func (f *outputFile) Commit() error {
+	// Temporary files are only readable by their owner.
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		return err
+	}
+
+	f.done = true
+	return nil
+}
+
+// Abort closes and removes the file, unless it's been committed.
+func (f *outputFile) Abort() {
+	if f.done {
+		return
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the progress of writing the context is shown, on a terminal and
+// otherwise.
+const (
+	progressInterval    = 100 * time.Millisecond
+	progressLogInterval = 5 * time.Second
+)
+
+// contextStats counts what's in a build context.
+type contextStats struct {
+	Files int
+	Bytes int64
+
+	// The sizes of every file, and of everything under every directory.
+	files map[string]int64
+	dirs  map[string]int64
+}
+
+func newContextStats() *contextStats {
+	return &contextStats{
+		files: make(map[string]int64),
+		dirs:  make(map[string]int64),
+	}
+}
+
+// Add counts a file with the given name in the context.
+func (s *contextStats) Add(name string, size int64) {
+	s.Files++
+	s.Bytes += size
+	s.files[name] = size
+
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		s.dirs[dir+"/"] += size
+	}
+}
+
+type sizeEntry struct {
+	Name string
+	Size int64
+}
+
+// Largest returns the n largest files and directories.
+func (s *contextStats) Largest(n int) (files, dirs []sizeEntry) {
+	return largestEntries(s.files, n), largestEntries(s.dirs, n)
+}
+
+func largestEntries(sizes map[string]int64, n int) []sizeEntry {
+	var ret []sizeEntry
+	for name, size := range sizes {
+		ret = append(ret, sizeEntry{name, size})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Size != ret[j].Size {
+			return ret[i].Size > ret[j].Size
+		}
+		return ret[i].Name < ret[j].Name
+	})
+
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// Print writes the totals, and the n largest files and directories.
+func (s *contextStats) Print(out io.Writer, prefix string, n int) {
+	fmt.Fprintf(out, "%sBuild context: %d files, %s\n", prefix, s.Files, formatBytes(s.Bytes))
+	if n <= 0 {
+		return
+	}
+
+	files, dirs := s.Largest(n)
+	for _, list := range []struct {
+		title   string
+		entries []sizeEntry
+	}{
+		{"Largest files", files},
+		{"Largest directories", dirs},
+	} {
+		if len(list.entries) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(out, "%s%s:\n", prefix, list.title)
+		for _, e := range list.entries {
+			fmt.Fprintf(out, "%s  %10s  %s\n", prefix, formatBytes(e.Size), e.Name)
+		}
+	}
+}
+
+// A contextProgress shows the progress of writing a build context, and
+// counts what's in it.  On a terminal, a single line is updated as files are
+// added; otherwise, a line is printed every so often.
+type contextProgress struct {
+	Stats *contextStats
+
+	out    io.Writer
+	prefix string
+	tty    bool
+	now    func() time.Time
+
+	// When progress was last shown, and whether there's a line to clear.
+	last  time.Time
+	shown bool
+}
+
+func newContextProgress(out io.Writer, prefix string, tty bool) *contextProgress {
+	return &contextProgress{
+		Stats:  newContextStats(),
+		out:    out,
+		prefix: prefix,
+		tty:    tty,
+		now:    time.Now,
+	}
+}
+
+// Add counts a file in the context, and shows the progress if it's been long
+// enough since it was last shown.
+func (p *contextProgress) Add(name string, info os.FileInfo) {
+	if info.IsDir() {
+		return
+	}
+
+	var size int64
+	if info.Mode().IsRegular() {
+		size = info.Size()
+	}
+	p.Stats.Add(name, size)
+
+	if p.out == nil {
+		return
+	}
+
+	now := p.now()
+	interval := progressLogInterval
+	if p.tty {
+		interval = progressInterval
+	}
+	if p.last.IsZero() {
+		// Don't show anything for small contexts that are written at once.
+		p.last = now
+		return
+	}
+	if now.Sub(p.last) < interval {
+		return
+	}
+	p.last = now
+
+	if p.tty {
+		// This is the VT100 escape sequence for "clear line".
+		fmt.Fprintf(p.out, "\r\033[2K%sAdding files: %d files, %s (%s)",
+			p.prefix, p.Stats.Files, formatBytes(p.Stats.Bytes), name)
+		p.shown = true
+	} else {
+		fmt.Fprintf(p.out, "%sAdding files: %d files, %s so far\n",
+			p.prefix, p.Stats.Files, formatBytes(p.Stats.Bytes))
+	}
+}
+
+// Finish clears the progress line, if one is being shown.
+func (p *contextProgress) Finish() {
+	if p.shown {
+		fmt.Fprintf(p.out, "\r\033[2K")
+		p.shown = false
+	}
+}
+
+// Returns whether the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Counts what's in a build context, without writing it.
+func scanContext(opts *contextOptions) (*contextStats, error) {
+	stats := newContextStats()
+
+	info, err := os.Stat(opts.DockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening Dockerfile: %s", err)
+	}
+	size := info.Size()
+	if opts.Dockerfile != nil {
+		size = int64(len(opts.Dockerfile))
+	}
+	stats.Add("Dockerfile", size)
+
+	err = walkContext(opts, func(path, rel string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		var size int64
+		if info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		stats.Add(filepath.ToSlash(rel), size)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error scanning build context: %s", err)
+	}
+	return stats, nil
+}
+
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// Formats a number of bytes for people to read.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(sizeUnits)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", size, sizeUnits[unit])
+}
+
+// Parses a size such as "500M" or "2GB".  A number on its own is in bytes.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(num, unit) {
+			num = strings.TrimSuffix(num, unit)
+			multiplier = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextStats(t *testing.T) {
+	t.Parallel()
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile":        "FROM busybox",
+		"app.js":            strings.Repeat("a", 100),
+		"data/dump.sql":     strings.Repeat("d", 5000),
+		"data/old/dump.sql": strings.Repeat("d", 2000),
+		"src/index.js":      strings.Repeat("i", 300),
+	})
+	defer os.RemoveAll(root)
+
+	stats, err := scanContext(&contextOptions{
+		DockerfilePath: filepath.Join(root, "Dockerfile"),
+		RootPath:       root,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, stats.Files, 5)
+	assert.Equal(t, stats.Bytes, int64(12+100+5000+2000+300))
+
+	files, dirs := stats.Largest(2)
+	assert.Equal(t, files, []sizeEntry{{"data/dump.sql", 5000}, {"data/old/dump.sql", 2000}})
+	assert.Equal(t, dirs, []sizeEntry{{"data/", 7000}, {"data/old/", 2000}})
+
+	var buf bytes.Buffer
+	stats.Print(&buf, "> ", 1)
+	assert.Equal(t, buf.String(), ""+
+		"> Build context: 5 files, 7.2 KB\n"+
+		"> Largest files:\n"+
+		">       4.9 KB  data/dump.sql\n"+
+		"> Largest directories:\n"+
+		">       6.8 KB  data/\n")
+}
+
+type fakeFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (f fakeFileInfo) IsDir() bool       { return false }
+func (f fakeFileInfo) Mode() os.FileMode { return 0644 }
+func (f fakeFileInfo) Size() int64       { return f.size }
+
+func TestContextProgress(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+	file := fakeFileInfo{size: 1024}
+
+	// On a terminal, one line is redrawn, but not too often.
+	var buf bytes.Buffer
+	p := newContextProgress(&buf, "", true)
+	p.now = clock
+	p.Add("a", file)
+	now = now.Add(50 * time.Millisecond)
+	p.Add("b", file)
+	now = now.Add(50 * time.Millisecond)
+	p.Add("c", file)
+	p.Finish()
+	assert.Equal(t, buf.String(), "\r\033[2KAdding files: 3 files, 3.0 KB (c)\r\033[2K")
+
+	// Otherwise, there's a line every so often.
+	buf.Reset()
+	p = newContextProgress(&buf, "app: ", false)
+	p.now = clock
+	for i := 0; i < 12; i++ {
+		p.Add("a", file)
+		now = now.Add(time.Second)
+	}
+	p.Finish()
+	assert.Equal(t, buf.String(), ""+
+		"app: Adding files: 6 files, 6.0 KB so far\n"+
+		"app: Adding files: 11 files, 11.0 KB so far\n")
+}
+
+func TestSizes(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, formatBytes(12), "12 B")
+	assert.Equal(t, formatBytes(1536), "1.5 KB")
+	assert.Equal(t, formatBytes(3<<30), "3.0 GB")
+
+	for s, expected := range map[string]int64{
+		"1024": 1024,
+		"2K":   2048,
+		"500M": 500 << 20,
+		"2GB":  2 << 30,
+		"1 t":  1 << 40,
+	} {
+		n, err := parseSize(s)
+		assert.NoError(t, err)
+		assert.Equal(t, n, expected, "parsing %q", s)
+	}
+
+	for _, s := range []string{"", "M", "-1", "2X"} {
+		_, err := parseSize(s)
+		assert.Error(t, err, "parsing %q", s)
+	}
+}
+
+func TestMaxContextSize(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		builds int
+	)
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, func(r *http.Request) {
+		if r.URL.Path == "/build" {
+			mu.Lock()
+			builds++
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	defer server.Stop()
+
+	conn := newTestConn(t, server.URL())
+
+	root := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+		"dump.sql":   strings.Repeat("d", 2000),
+	})
+	defer os.RemoveAll(root)
+
+	b := &imageBuild{
+		Context: &contextOptions{
+			DockerfilePath: filepath.Join(root, "Dockerfile"),
+			RootPath:       root,
+		},
+		Name:           "myapp",
+		MaxContextSize: 1024,
+		Stream:         true,
+	}
+	err = b.Run(conn)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "more than the maximum of 1.0 KB")
+	}
+
+	// Nothing was sent to Docker.
+	mu.Lock()
+	assert.Equal(t, builds, 0)
+	mu.Unlock()
+
+	b.MaxContextSize = 1 << 20
+	assert.NoError(t, b.Run(conn))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrew-d/docker-tools/log"
+)
+
+// Finds the root directory of the build context from the command line.  As
+// well as a directory, the root can be a tar file, a git repository and ref
+// ("path/to/repo#ref"), or "-" for a tar file on stdin.  These are extracted
+// to a temporary directory, which is removed by the returned function.
+func prepareRoot(root string, stdin io.Reader) (string, func(), error) {
+	nothing := func() {}
+
+	if root == "-" {
+		return extractRoot("stdin", stdin, true)
+	}
+
+	if idx := strings.LastIndex(root, "#"); idx >= 0 {
+		if info, err := os.Stat(root[:idx]); err == nil && info.IsDir() {
+			return gitRoot(root[:idx], root[idx+1:])
+		}
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", nothing, fmt.Errorf("Error opening root path: %s", err)
+	}
+	if info.Mode().IsRegular() {
+		f, err := os.Open(root)
+		if err != nil {
+			return "", nothing, fmt.Errorf("Error opening root path: %s", err)
+		}
+		defer f.Close()
+		return extractRoot(root, f, true)
+	}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", nothing, fmt.Errorf("Error finding absolute path (2): %s", err)
+	}
+	return abs, nothing, nil
+}
+
+// Exports the tree at the given ref of a git repository, without touching
+// its working copy.
+func gitRoot(repo, ref string) (string, func(), error) {
+	if len(ref) == 0 {
+		return "", func() {}, fmt.Errorf("No git ref given for %s", repo)
+	}
+
+	cmd := exec.Command("git", "archive", "--format=tar", ref)
+	cmd.Dir = repo
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return "", func() {}, fmt.Errorf("Error running git: %s", err)
+	}
+
+	root, cleanup, err := extractRoot(repo+"#"+ref, out, false)
+
+	// Read anything left over, so that git can exit.
+	io.Copy(ioutil.Discard, out)
+	if waitErr := cmd.Wait(); waitErr != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("Error exporting %s from %s: %s (%s)",
+			ref, repo, waitErr, strings.TrimSpace(stderr.String()))
+	}
+	return root, cleanup, err
+}
+
+// Extracts a tar file, which may be gzipped, to a new temporary directory.
+// If reroot is set, and everything in it is under a single directory, that
+// directory is returned as the root.
+func extractRoot(name string, r io.Reader, reroot bool) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "dbuild-root")
+	if err != nil {
+		return "", func() {}, fmt.Errorf("Error creating temporary directory: %s", err)
+	}
+	cleanup := func() { removeTree(dir) }
+
+	log.Infof("Extracting build context from %s...", name)
+	if err = extractTar(r, dir); err != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("Error extracting %s: %s", name, err)
+	}
+
+	root := dir
+	if reroot {
+		entries, err := ioutil.ReadDir(dir)
+		if err == nil && len(entries) == 1 && entries[0].IsDir() {
+			root = filepath.Join(dir, entries[0].Name())
+		}
+	}
+	return root, cleanup, nil
+}
+
+// Extracts a tar file, which may be gzipped, into a directory.
+func extractTar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	// Modes and times of directories are set last, since adding files to
+	// them would change their times, and they may not be writable.
+	type dirInfo struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirInfo
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Cleaning the name as an absolute path keeps it inside the directory.
+		rel := path.Clean("/" + hdr.Name)
+		if rel == "/" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+		if err = checkExtractPath(dir, target); err != nil {
+			return err
+		}
+
+		// A later entry replaces an earlier one, and mustn't write through
+		// it if it's a symlink.
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err = os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirInfo{target, hdr})
+
+		case tar.TypeReg, tar.TypeRegA:
+			if err = extractFile(tr, target, hdr); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			source := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+hdr.Linkname)))
+			if err = checkExtractPath(dir, source); err != nil {
+				return err
+			}
+			if err = os.Link(source, target); err != nil {
+				return err
+			}
+
+		default:
+			// Devices, FIFOs and global headers don't belong in a context.
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := os.Chmod(d.path, os.FileMode(d.hdr.Mode).Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.hdr.ModTime, d.hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, hdr *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(target, os.FileMode(hdr.Mode).Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, time.Now(), hdr.ModTime)
+}
+
+// Makes sure that nothing is written outside the directory by way of a
+// symlink that was extracted earlier.
+func checkExtractPath(dir, target string) error {
+	// Anything that doesn't exist yet will be created as a plain directory,
+	// so only the closest existing parent matters.
+	parent := filepath.Dir(target)
+	for {
+		resolved, err := filepath.EvalSymlinks(parent)
+		if err == nil {
+			parent = resolved
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent = filepath.Dir(parent)
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if parent != realDir && !strings.HasPrefix(parent, realDir+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the build context", target)
+	}
+	return nil
+}
+
+// Removes a directory and everything under it, even if some of the
+// directories under it aren't writable.
+func removeTree(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	os.RemoveAll(dir)
+}
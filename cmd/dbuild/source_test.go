@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tarEntry struct {
+	Name     string
+	Type     byte
+	Contents string
+	Linkname string
+}
+
+// Makes a tar file with the given entries, gzipping it if asked.
+func makeTar(t *testing.T, entries []tarEntry, gzipped bool) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.Name,
+			Typeflag: e.Type,
+			Linkname: e.Linkname,
+			Mode:     0644,
+			Size:     int64(len(e.Contents)),
+		}
+		if e.Type == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.Type != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing tar: %s", err)
+		}
+		tw.Write([]byte(e.Contents))
+	}
+	tw.Close()
+
+	if !gzipped {
+		return buf.Bytes()
+	}
+
+	var gzbuf bytes.Buffer
+	gz := gzip.NewWriter(&gzbuf)
+	gz.Write(buf.Bytes())
+	gz.Close()
+	return gzbuf.Bytes()
+}
+
+func TestPrepareRootTar(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTree(t, map[string]string{
+		"Dockerfile.prod": "FROM busybox",
+	})
+	defer os.RemoveAll(dir)
+
+	// Everything's under a single directory, which becomes the root.
+	tarPath := filepath.Join(dir, "src.tar.gz")
+	ioutil.WriteFile(tarPath, makeTar(t, []tarEntry{
+		{Name: "proj-1.0/", Type: tar.TypeDir},
+		{Name: "proj-1.0/Dockerfile", Type: tar.TypeReg, Contents: "FROM scratch"},
+		{Name: "proj-1.0/app.js", Type: tar.TypeReg, Contents: "app"},
+		{Name: "proj-1.0/lib/util.js", Type: tar.TypeReg, Contents: "util"},
+		{Name: "proj-1.0/current", Type: tar.TypeSymlink, Linkname: "app.js"},
+	}, true), 0644)
+
+	root, cleanup, err := prepareRoot(tarPath, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, filepath.Base(root), "proj-1.0")
+
+	// The Dockerfile from the tar file is replaced, just as it would be in
+	// a directory.
+	opts := &contextOptions{
+		DockerfilePath: filepath.Join(dir, "Dockerfile.prod"),
+		RootPath:       root,
+	}
+	assert.Equal(t, contextNames(t, opts), []string{
+		"Dockerfile", "app.js", "current", "lib/", "lib/util.js",
+	})
+	headers := contextHeaders(t, opts)
+	assert.Equal(t, headers["Dockerfile"].Size, int64(len("FROM busybox")))
+	assert.Equal(t, headers["current"].Linkname, "app.js")
+
+	cleanup()
+	_, err = os.Stat(root)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrepareRootStdin(t *testing.T) {
+	t.Parallel()
+
+	stdin := bytes.NewReader(makeTar(t, []tarEntry{
+		{Name: "app.js", Type: tar.TypeReg, Contents: "app"},
+		{Name: "lib/util.js", Type: tar.TypeReg, Contents: "util"},
+	}, false))
+
+	root, cleanup, err := prepareRoot("-", stdin)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup()
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "lib", "util.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "util")
+}
+
+func TestExtractTarOutsideRoot(t *testing.T) {
+	t.Parallel()
+
+	outside, err := ioutil.TempDir("", "dbuild-outside")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(outside)
+
+	tests := [][]tarEntry{
+		// Writing through a symlinked directory.
+		{
+			{Name: "link", Type: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/evil", Type: tar.TypeReg, Contents: "evil"},
+		},
+		{
+			{Name: "link", Type: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/sub/evil", Type: tar.TypeReg, Contents: "evil"},
+		},
+		// Writing through a symlinked file.
+		{
+			{Name: "link", Type: tar.TypeSymlink, Linkname: filepath.Join(outside, "evil")},
+			{Name: "link", Type: tar.TypeReg, Contents: "evil"},
+		},
+		// Names that go up a level stay inside.
+		{
+			{Name: "../../evil", Type: tar.TypeReg, Contents: "evil"},
+		},
+	}
+
+	for i, entries := range tests {
+		_, cleanup, _ := prepareRoot("-", bytes.NewReader(makeTar(t, entries, false)))
+		cleanup()
+
+		files, _ := ioutil.ReadDir(outside)
+		assert.Equal(t, len(files), 0, "test %d wrote outside the root", i)
+	}
+}
+
+func TestPrepareRootGit(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo := makeTree(t, map[string]string{
+		"Dockerfile": "FROM busybox",
+		"app.js":     "one",
+	})
+	defer os.RemoveAll(repo)
+
+	git := func(args ...string) string {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Error running git %v: %s (%s)", args, err, out)
+		}
+		return string(bytes.TrimSpace(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "First")
+	first := git("rev-parse", "HEAD")
+
+	ioutil.WriteFile(filepath.Join(repo, "app.js"), []byte("two"), 0644)
+	ioutil.WriteFile(filepath.Join(repo, "new.js"), []byte("new"), 0644)
+
+	root, cleanup, err := prepareRoot(repo+"#"+first, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup()
+
+	// The root is the tree at that commit, not the working copy, which is
+	// left alone.
+	data, err := ioutil.ReadFile(filepath.Join(root, "app.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "one")
+	_, err = os.Stat(filepath.Join(root, "new.js"))
+	assert.True(t, os.IsNotExist(err))
+
+	data, err = ioutil.ReadFile(filepath.Join(repo, "app.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "two")
+
+	_, _, err = prepareRoot(repo+"#no-such-ref", nil)
+	assert.Error(t, err)
+}
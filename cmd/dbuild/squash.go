@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Flattens an image into a single layer, and gives the flattened image the
+// same name and config as the original.  The original image is left in place,
+// untagged, so that it can still be used as a build cache, unless the caller
+// removes it.
+func squashImage(client *docker.Client, img *docker.Image, name string) (*docker.Image, error) {
+	// Stream the image's filesystem out of a container and straight back in
+	// as a new image.  The container is never started.
+	container, err := createSquashContainer(client, img.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer removeSquashContainer(client, container.ID)
+
+	tmpName := "dbuild-squash-" + strings.ToLower(randString(12))
+	pr, pw := io.Pipe()
+	exportErr := make(chan error, 1)
+	go func() {
+		err := client.ExportContainer(docker.ExportContainerOptions{
+			ID:           container.ID,
+			OutputStream: pw,
+		})
+		pw.CloseWithError(err)
+		exportErr <- err
+	}()
+
+	err = client.ImportImage(docker.ImportImageOptions{
+		Repository:   tmpName,
+		Source:       "-",
+		InputStream:  pr,
+		OutputStream: ioutil.Discard,
+	})
+	pr.Close()
+
+	// If the import fails, the export fails too, since nothing's reading
+	// it, so the import's error is the one that matters.
+	if err != nil {
+		<-exportErr
+		return nil, fmt.Errorf("Error importing flattened image: %s", err)
+	}
+	if err := <-exportErr; err != nil {
+		return nil, fmt.Errorf("Error exporting image contents: %s", err)
+	}
+	defer func() {
+		if err := client.RemoveImage(tmpName); err != nil {
+			log.Errorf("Error removing temporary image %s: %s", tmpName, err)
+		}
+	}()
+
+	// An imported image has no config, so commit a container made from it
+	// with the original image's.
+	flat, err := createSquashContainer(client, tmpName)
+	if err != nil {
+		return nil, err
+	}
+	defer removeSquashContainer(client, flat.ID)
+
+	repo, tag := parseRepositoryTag(name)
+	_, err = client.CommitContainer(docker.CommitContainerOptions{
+		Container:  flat.ID,
+		Repository: repo,
+		Tag:        tag,
+		Author:     img.Author,
+		Run:        squashConfig(img.Config),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error committing flattened image: %s", err)
+	}
+
+	ret, err := client.InspectImage(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error inspecting flattened image: %s", err)
+	}
+	return ret, nil
+}
+
+// Returns the parts of an image's config that describe how to run it.
+func squashConfig(config *docker.Config) *docker.Config {
+	if config == nil {
+		return &docker.Config{}
+	}
+
+	return &docker.Config{
+		Env:          config.Env,
+		Cmd:          config.Cmd,
+		Entrypoint:   config.Entrypoint,
+		ExposedPorts: config.ExposedPorts,
+		WorkingDir:   config.WorkingDir,
+		User:         config.User,
+		Volumes:      config.Volumes,
+	}
+}
+
+func createSquashContainer(client *docker.Client, image string) (*docker.Container, error) {
+	// The command is required, but since the container is never started,
+	// it doesn't matter what it is.
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: image,
+			Cmd:   []string{"true"},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating container from %s: %s", image, err)
+	}
+	return container, nil
+}
+
+func removeSquashContainer(client *docker.Client, id string) {
+	err := client.RemoveContainer(docker.RemoveContainerOptions{ID: id})
+	if err != nil {
+		log.Errorf("Error removing temporary container %s: %s", id, err)
+	}
+}
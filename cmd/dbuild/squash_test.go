@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake Docker daemon that handles just the calls needed to squash an image.
+type squashServer struct {
+	mu         sync.Mutex
+	containers map[string]string // ID -> image
+	removed    []string
+	imported   map[string]string // repo -> contents
+	committed  *docker.Config
+	commitRepo string
+
+	// If set, imports fail without reading what's being imported.
+	failImport bool
+}
+
+func (s *squashServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.failImport && r.URL.Path == "/images/create" {
+		http.Error(w, "no space left on device", http.StatusInternalServerError)
+		return
+	}
+
+	// Imports read what's being exported, so the body has to be read before
+	// locking.
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case r.Method == "POST" && path == "/containers/create":
+		var config docker.Config
+		json.Unmarshal(body, &config)
+		id := fmt.Sprintf("c%d", len(s.containers)+1)
+		s.containers[id] = config.Image
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q}`, id)
+
+	case r.Method == "GET" && strings.HasSuffix(path, "/export"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/export")
+		fmt.Fprintf(w, "contents of %s", s.containers[id])
+		if s.failImport {
+			// Enough that the import can't have read it all.
+			w.Write(make([]byte, 16<<20))
+		}
+
+	case r.Method == "POST" && path == "/images/create":
+		s.imported[r.URL.Query().Get("repo")] = string(body)
+
+	case r.Method == "POST" && path == "/commit":
+		s.committed = &docker.Config{}
+		json.Unmarshal(body, s.committed)
+		s.commitRepo = r.URL.Query().Get("repo") + ":" + r.URL.Query().Get("tag")
+		fmt.Fprint(w, `{"Id":"flat"}`)
+
+	case r.Method == "DELETE":
+		s.removed = append(s.removed, path)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" && path == "/images/myapp:1.0/json":
+		fmt.Fprint(w, `{"Id":"flat","Size":100}`)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSquashImage(t *testing.T) {
+	t.Parallel()
+
+	fake := &squashServer{
+		containers: make(map[string]string),
+		imported:   make(map[string]string),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	img := &docker.Image{
+		ID:   "layered",
+		Size: 500,
+		Config: &docker.Config{
+			Env:          []string{"PATH=/bin"},
+			Cmd:          []string{"serve"},
+			Entrypoint:   []string{"/app"},
+			ExposedPorts: map[docker.Port]struct{}{"80/tcp": {}},
+			WorkingDir:   "/srv",
+			Hostname:     "builder",
+		},
+	}
+	flat, err := squashImage(client, img, "myapp:1.0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, flat.Size, int64(100))
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	// The original image's contents were imported under a temporary name...
+	assert.Equal(t, fake.containers["c1"], "layered")
+	assert.Equal(t, len(fake.imported), 1)
+	var tmpName string
+	for repo, contents := range fake.imported {
+		tmpName = repo
+		assert.Equal(t, contents, "contents of layered")
+	}
+	assert.True(t, strings.HasPrefix(tmpName, "dbuild-squash-"))
+
+	// ... and committed with the original config.
+	assert.Equal(t, fake.containers["c2"], tmpName)
+	assert.Equal(t, fake.commitRepo, "myapp:1.0")
+	if assert.NotNil(t, fake.committed) {
+		assert.Equal(t, fake.committed.Env, img.Config.Env)
+		assert.Equal(t, fake.committed.Cmd, img.Config.Cmd)
+		assert.Equal(t, fake.committed.Entrypoint, img.Config.Entrypoint)
+		assert.Equal(t, fake.committed.ExposedPorts, img.Config.ExposedPorts)
+		assert.Equal(t, fake.committed.WorkingDir, "/srv")
+		assert.Equal(t, fake.committed.Hostname, "")
+	}
+
+	// Everything temporary was cleaned up.
+	assert.Equal(t, fake.removed, []string{
+		"/containers/c2",
+		"/images/" + tmpName,
+		"/containers/c1",
+	})
+}
+
+func TestSquashImageImportFailure(t *testing.T) {
+	t.Parallel()
+
+	fake := &squashServer{
+		containers: make(map[string]string),
+		imported:   make(map[string]string),
+		failImport: true,
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	// The import's error is reported, not the export's.
+	_, err = squashImage(client, &docker.Image{ID: "layered"}, "myapp:1.0")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Error importing flattened image")
+		assert.Contains(t, err.Error(), "no space left on device")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Splits an image name into its repository and tag.  The tag defaults to
+// "latest".
+func parseRepositoryTag(name string) (repo, tag string) {
+	// A ':' before the last '/' is part of the registry's host name.
+	idx := strings.LastIndex(name, ":")
+	if idx < 0 || strings.Contains(name[idx+1:], "/") {
+		return name, "latest"
+	}
+	return name[:idx], name[idx+1:]
+}
+
+// Applies each of the given tags to the image, returning the tags that
+// couldn't be applied.
+func tagImage(client *docker.Client, image string, tags []string) []string {
+	var failed []string
+
+	for _, name := range tags {
+		repo, tag := parseRepositoryTag(name)
+
+		err := client.TagImage(image, docker.TagImageOptions{
+			Repo:  repo,
+			Tag:   tag,
+			Force: true,
+		})
+		if err != nil {
+			log.Errorf("Error tagging image as %s: %s", name, err)
+			failed = append(failed, name)
+			continue
+		}
+
+		log.Infof("Tagged image as %s", name)
+	}
+
+	return failed
+}
+
+// Pushes each of the given tags, using the given registry credentials, and
+// returns the tags that couldn't be pushed.
+func pushTags(client *docker.Client, tags []string, auths map[string]docker.AuthConfiguration, out io.Writer) []string {
+	var failed []string
+
+	for _, name := range tags {
+		repo, tag := parseRepositoryTag(name)
+		log.Infof("Pushing %s...", name)
+
+		output := &pushOutput{out: out, prefix: fmt.Sprintf("   [push %s] ", name)}
+		err := client.PushImage(docker.PushImageOptions{
+			Name:         repo,
+			Tag:          tag,
+			OutputStream: output,
+		}, auths[repositoryRegistry(repo)])
+		output.Finish()
+
+		if err != nil {
+			log.Errorf("Error pushing %s: %s", name, err)
+			failed = append(failed, name)
+			continue
+		}
+
+		log.Infof("Pushed %s", name)
+	}
+
+	return failed
+}
+
+// pushOutput renders the output of a push.  Progress bars, which end in a
+// carriage return, are all shown on the same line.
+type pushOutput struct {
+	out    io.Writer
+	prefix string
+
+	// The progress line currently being shown, if any.
+	progress string
+}
+
+func (p *pushOutput) Write(b []byte) (int, error) {
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasSuffix(line, "\r") {
+			// This is the VT100 escape sequence for "clear line".
+			p.progress = strings.TrimSuffix(line, "\r")
+			fmt.Fprintf(p.out, "\r\033[2K%s%s", p.prefix, p.progress)
+			continue
+		}
+
+		// The status of a progress message is also written on its own, which
+		// we don't need to show again.
+		line = strings.TrimRight(line, "\r\n")
+		if len(p.progress) > 0 && strings.HasPrefix(p.progress, line+" ") {
+			continue
+		}
+
+		p.Finish()
+		fmt.Fprintf(p.out, "%s%s\n", p.prefix, line)
+	}
+
+	return len(b), nil
+}
+
+// Finish ends any progress line that's being shown.
+func (p *pushOutput) Finish() {
+	if len(p.progress) > 0 {
+		fmt.Fprintln(p.out)
+		p.progress = ""
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRepositoryTag(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name, Repo, Tag string
+	}{
+		{"myapp", "myapp", "latest"},
+		{"myapp:1.0", "myapp", "1.0"},
+		{"andrew-d/myapp:dev", "andrew-d/myapp", "dev"},
+		{"localhost:5000/myapp", "localhost:5000/myapp", "latest"},
+		{"localhost:5000/myapp:1.0", "localhost:5000/myapp", "1.0"},
+	}
+
+	for _, test := range tests {
+		repo, tag := parseRepositoryTag(test.Name)
+		assert.Equal(t, repo, test.Repo, test.Name)
+		assert.Equal(t, tag, test.Tag, test.Name)
+	}
+}
+
+func TestTagAndPush(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu    sync.Mutex
+		auths = make(map[string]string)
+	)
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, func(r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/push") {
+			mu.Lock()
+			auths[r.URL.Path] = r.Header.Get("X-Registry-Auth")
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	defer server.Stop()
+
+	conn := newTestConn(t, server.URL())
+	client := conn.Client
+
+	// Build an image to tag.  The fake server only knows about images by
+	// the name they were built with, so that's the only one that can be
+	// pushed.
+	var ctx bytes.Buffer
+	tw := tar.NewWriter(&ctx)
+	tw.WriteHeader(&tar.Header{Name: "Dockerfile", Size: 12, Mode: 0644})
+	tw.Write([]byte("FROM busybox"))
+	tw.Close()
+
+	var out bytes.Buffer
+	err = buildImage(conn, docker.BuildImageOptions{
+		Name:        "localhost:5000/myapp",
+		InputStream: &ctx,
+	}, newBuildReporter(&out, nil))
+	if err != nil {
+		t.Fatalf("Error building image: %s", err)
+	}
+
+	// The fake server doesn't support tagging.
+	var tagged []string
+	server.CustomHandler("/images/localhost:5000/myapp/tag", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, q.Get("force"), "1")
+		tagged = append(tagged, q.Get("repo")+":"+q.Get("tag"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	tags := []string{"localhost:5000/myapp:1.0", "other/app"}
+	failed := tagImage(client, "localhost:5000/myapp", tags)
+	assert.Equal(t, len(failed), 0)
+	assert.Equal(t, tagged, []string{"localhost:5000/myapp:1.0", "other/app:latest"})
+
+	creds := map[string]docker.AuthConfiguration{
+		"localhost:5000": {Username: "user", Password: "secret"},
+	}
+	out.Reset()
+	failed = pushTags(client, tags, creds, &out)
+	assert.Equal(t, failed, []string{"other/app"})
+	assert.Equal(t, out.String(), ""+
+		"   [push localhost:5000/myapp:1.0] Pushing...\n"+
+		"   [push localhost:5000/myapp:1.0] Pushed\n")
+
+	// The credentials for the registry are sent along.
+	mu.Lock()
+	encoded := auths["/images/localhost:5000/myapp/push"]
+	mu.Unlock()
+	data, err := base64.URLEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	var sent docker.AuthConfiguration
+	assert.NoError(t, json.Unmarshal(data, &sent))
+	assert.Equal(t, sent, creds["localhost:5000"])
+}
+
+func TestPushOutput(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	p := &pushOutput{out: &out, prefix: "> "}
+	p.Write([]byte("The push refers to a repository [myapp]\n"))
+	p.Write([]byte("Pushing [=>   ] 1 MB\r"))
+	p.Write([]byte("Pushing\n"))
+	p.Write([]byte("Pushing [====>] 4 MB\r"))
+	p.Write([]byte("Pushing\n"))
+	p.Write([]byte("Image successfully pushed\n"))
+	p.Write([]byte("Buffering [=> ] 1 MB\r"))
+	p.Finish()
+
+	assert.Equal(t, out.String(), ""+
+		"> The push refers to a repository [myapp]\n"+
+		"\r\033[2K> Pushing [=>   ] 1 MB"+
+		"\r\033[2K> Pushing [====>] 4 MB\n"+
+		"> Image successfully pushed\n"+
+		"\r\033[2K> Buffering [=> ] 1 MB\n")
+}
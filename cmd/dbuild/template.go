@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Returns the variables that a Dockerfile template is filled from: the
+// environment, then the variables file (if any), and then the variables
+// given on the command line, with later ones overriding earlier ones.
+func templateVars(environ []string, varsFile string, vars []string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, kv := range environ {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			ret[parts[0]] = parts[1]
+		}
+	}
+
+	if len(varsFile) > 0 {
+		fileVars, err := readVarsFile(varsFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fileVars {
+			ret[k] = v
+		}
+	}
+
+	for _, kv := range vars {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("Invalid variable %q: expected KEY=VALUE", kv)
+		}
+		ret[parts[0]] = parts[1]
+	}
+
+	return ret, nil
+}
+
+// Reads a file of variables, one KEY=VALUE per line.  Blank lines and lines
+// starting with '#' are skipped, and values may be quoted.
+func readVarsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading variables file: %s", err)
+	}
+	defer f.Close()
+
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(key) == 0 {
+			return nil, fmt.Errorf("Invalid line %d in %s: expected KEY=VALUE", lineNo, path)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		ret[key] = value
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading variables file: %s", err)
+	}
+	return ret, nil
+}
+
+// Renders the Dockerfile at the given path as a template.  It's an error for
+// the template to use a variable that isn't set.
+func renderDockerfile(path string, vars map[string]string) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing Dockerfile template: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("Error rendering Dockerfile: %s", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateVars(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTree(t, map[string]string{
+		"vars": "# Versions\n" +
+			"\n" +
+			"VERSION = 1.0\n" +
+			"NAME=\"my app\"\n" +
+			"BASE='debian:jessie'\n",
+		"bad": "VERSION\n",
+	})
+	defer os.RemoveAll(dir)
+
+	environ := []string{"HOME=/root", "VERSION=0.1", "NAME=env"}
+	vars, err := templateVars(environ, filepath.Join(dir, "vars"), []string{"NAME=flag", "EMPTY="})
+	assert.NoError(t, err)
+	assert.Equal(t, vars, map[string]string{
+		"HOME":    "/root",
+		"VERSION": "1.0",
+		"NAME":    "flag",
+		"BASE":    "debian:jessie",
+		"EMPTY":   "",
+	})
+
+	_, err = templateVars(nil, filepath.Join(dir, "bad"), nil)
+	assert.Error(t, err)
+	_, err = templateVars(nil, filepath.Join(dir, "missing"), nil)
+	assert.Error(t, err)
+	_, err = templateVars(nil, "", []string{"VERSION"})
+	assert.Error(t, err)
+}
+
+func TestRenderDockerfile(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTree(t, map[string]string{
+		"Dockerfile": "FROM {{.BASE}}\nENV VERSION {{.VERSION}}\n",
+		"app.js":     "",
+	})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Dockerfile")
+
+	data, err := renderDockerfile(path, map[string]string{"BASE": "busybox", "VERSION": "1.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "FROM busybox\nENV VERSION 1.0\n")
+
+	_, err = renderDockerfile(path, map[string]string{"BASE": "busybox"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "VERSION")
+	}
+
+	// The rendered Dockerfile is what goes into the context.
+	headers := contextHeaders(t, &contextOptions{
+		DockerfilePath: path,
+		RootPath:       dir,
+		Dockerfile:     data,
+	})
+	if assert.NotNil(t, headers["Dockerfile"]) {
+		assert.Equal(t, headers["Dockerfile"].Size, int64(len(data)))
+	}
+}
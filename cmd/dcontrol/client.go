@@ -2,26 +2,50 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"io/ioutil"
+	"net/url"
 
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/exitcode"
 	"github.com/fsouza/go-dockerclient"
 )
 
-func getClient() (*docker.Client, error) {
-	host := os.Getenv("DOCKER_HOST")
-	if len(host) == 0 {
-		host = "unix:///var/run/docker.sock"
+// Connects to Docker, using the options from the command line.
+func connect() (*dockerconn.Conn, error) {
+	conn, err := dockerconn.New(flagDocker)
+	if err != nil {
+		return nil, exitcode.With(exitConfig, err)
+	}
+
+	err = conn.Ping()
+	if err != nil {
+		return nil, exitcode.With(exitConnection, err)
 	}
 
-	client, err := docker.NewClient(host)
+	return conn, nil
+}
+
+func getClient() (*docker.Client, error) {
+	conn, err := connect()
 	if err != nil {
-		return nil, fmt.Errorf("Error creating: %s", err)
+		return nil, err
 	}
+	return conn.Client, nil
+}
 
-	err = client.Ping()
+// The version of go-dockerclient that we use doesn't support renaming
+// containers, so we make the request ourselves.
+func renameContainer(conn *dockerconn.Conn, id, name string) error {
+	path := fmt.Sprintf("/containers/%s/rename?name=%s", id, url.QueryEscape(name))
+	resp, err := conn.HTTPClient.Post(conn.URL(path), "plain/text", nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error pinging: %s", err)
+		return err
 	}
+	defer resp.Body.Close()
 
-	return client, nil
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("API error (%d): %s", resp.StatusCode, body)
+	}
+	return nil
 }
@@ -3,12 +3,13 @@ package main
 import (
 	"fmt"
 
+	"github.com/andrew-d/docker-tools/exitcode"
 	"github.com/andrew-d/docker-tools/log"
 	"github.com/fsouza/go-dockerclient"
 )
 
 func checkContainerExists(client *docker.Client, container *Container) (bool, error) {
-	inspect, err := client.InspectContainer(container.Name)
+	inspect, err := client.InspectContainer(container.DockerName())
 	if err != nil {
 		if _, ok := err.(*docker.NoSuchContainer); ok {
 			return false, nil
@@ -36,11 +37,20 @@ func checkContainerExists(client *docker.Client, container *Container) (bool, er
 }
 
 func createContainer(client *docker.Client, container *Container) error {
+	_, err := createContainerAs(client, container, container.DockerName())
+	return err
+}
+
+// Creates a container from the given config, but with a different name in
+// Docker.
+func createContainerAs(client *docker.Client, container *Container, name string) (*docker.Container, error) {
 	// Set the options used when creating our container.
 	opts := docker.CreateContainerOptions{
-		Name: container.Name,
+		Name: name,
 		Config: &docker.Config{
-			Image: container.Image,
+			Image:        container.Image,
+			ExposedPorts: make(map[docker.Port]struct{}),
+			Volumes:      make(map[string]struct{}),
 		},
 	}
 
@@ -59,32 +69,32 @@ func createContainer(client *docker.Client, container *Container) error {
 			log.Warnf("%s: Currently only support one 'volumes-from'.  The last entry will be used.",
 				container.Name)
 		}
-		opts.Config.VolumesFrom = mfrom
+		opts.Config.VolumesFrom = dockerName(container.Project, mfrom)
 	}
 
 	// Create the container.
-	_, err := client.CreateContainer(opts)
-	return err
+	return client.CreateContainer(opts)
 }
 
-func cmdCreate(config *Config) {
+func cmdCreate(config *Config) (err error) {
 	client, err := getClient()
 	if err != nil {
-		log.Errorf("Error getting client: %s", err)
-		return
+		return err
 	}
 
 	created := 0
 	skipped := 0
 
+	// Anything created before a failure makes it a partial success.
+	defer func() { err = exitcode.PartialError(created, err) }()
+
 	for _, idx := range config.ContainerSort {
 		container := config.Containers[idx]
 
 		// Check if the container exists.
 		exists, err := checkContainerExists(client, container)
 		if err != nil {
-			log.Errorf("%s: %s", container.Name, err)
-			return
+			return fmt.Errorf("%s: %s", container.Name, err)
 		} else if exists {
 			log.Infof("%s: Container exists, skipping...", container.Name)
 			skipped++
@@ -95,8 +105,7 @@ func cmdCreate(config *Config) {
 
 		err = createContainer(client, container)
 		if err != nil {
-			log.Errorf("%s: Error creating: %s", container.Name, err)
-			return
+			return fmt.Errorf("%s: Error creating: %s", container.Name, err)
 		}
 
 		log.Infof("%s: Created container", container.Name)
@@ -106,4 +115,6 @@ func cmdCreate(config *Config) {
 	log.Infof("Finished creating containers")
 	log.Infof("Total: %d (%d created / %d skipped)",
 		len(config.Containers), created, skipped)
+
+	return nil
 }
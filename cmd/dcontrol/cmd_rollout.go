@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/exitcode"
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// How long to wait for an old container to stop before Docker kills it.
+const rolloutStopTimeout = 10
+
+// A replacement is a new container that's being rolled out in place of an
+// existing one.
+type replacement struct {
+	container *Container
+	oldID     string
+	newID     string
+
+	// Whether we had to stop the old container before starting the new one.
+	stoppedOld bool
+
+	// The result of the readiness check.
+	err error
+}
+
+// Returns the ID of the existing container, and whether the image it's using
+// differs from the image in the config.
+func checkImageChanged(client *docker.Client, container *Container) (string, bool, error) {
+	inspect, err := client.InspectContainer(container.DockerName())
+	if err != nil {
+		return "", false, err
+	}
+
+	imageInfo, err := client.InspectImage(container.Image)
+	if err != nil {
+		if err == docker.ErrNoSuchImage {
+			return "", false, fmt.Errorf("No such image (%s)", container.Image)
+		}
+		return "", false, fmt.Errorf("Error inspecting image: %s", err)
+	}
+
+	return inspect.ID, inspect.Image != imageInfo.ID, nil
+}
+
+// Whether the container binds to a specific port on the host.  If so, the
+// replacement can't run alongside the old container.
+func hasFixedHostPorts(container *Container) bool {
+	for _, port := range container.Ports {
+		if port.HostPort != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits the containers to be replaced (in dependency order) into batches of
+// at most max containers.  A container is never in the same batch as one of
+// its dependencies, since the dependency must be replaced first.
+func rolloutBatches(containers []*Container, max int) [][]*Container {
+	if max < 1 {
+		max = 1
+	}
+
+	ret := [][]*Container{}
+	batch := []*Container{}
+	inBatch := make(map[string]bool)
+
+	for _, c := range containers {
+		split := len(batch) == max
+		for _, dep := range c.Dependencies {
+			if inBatch[dep.Name] {
+				split = true
+			}
+		}
+
+		if split {
+			ret = append(ret, batch)
+			batch = []*Container{}
+			inBatch = make(map[string]bool)
+		}
+
+		batch = append(batch, c)
+		inBatch[c.Name] = true
+	}
+
+	if len(batch) > 0 {
+		ret = append(ret, batch)
+	}
+	return ret
+}
+
+// Waits for the given container to become ready.  A container is ready if
+// it's still running after the given delay, and, if it has a ready port, once
+// that port accepts connections.
+func waitReady(client *docker.Client, container *Container, id string, delay, timeout time.Duration) error {
+	time.Sleep(delay)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inspect, err := client.InspectContainer(id)
+		if err != nil {
+			return err
+		}
+		if !inspect.State.Running {
+			return fmt.Errorf("Container exited with code %d", inspect.State.ExitCode)
+		}
+		if container.ReadyPort == 0 {
+			return nil
+		}
+
+		// The container may not have an address yet.
+		err = fmt.Errorf("Container has no IP address")
+		if inspect.NetworkSettings != nil && len(inspect.NetworkSettings.IPAddress) > 0 {
+			addr := net.JoinHostPort(inspect.NetworkSettings.IPAddress,
+				strconv.Itoa(int(container.ReadyPort)))
+
+			var conn net.Conn
+			conn, err = net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				conn.Close()
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Port %d not ready after %s: %s", container.ReadyPort, timeout, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func startReplacement(client *docker.Client, r *replacement) error {
+	container := r.container
+	name := container.DockerName() + "_next"
+
+	// Remove any replacement left over from a previous rollout.
+	err := client.RemoveContainer(docker.RemoveContainerOptions{ID: name, Force: true})
+	if err == nil {
+		log.Warnf("%s: Removed leftover replacement container", container.Name)
+	} else if _, ok := err.(*docker.NoSuchContainer); !ok {
+		return fmt.Errorf("Error removing leftover replacement: %s", err)
+	}
+
+	if hasFixedHostPorts(container) {
+		log.Warnf("%s: Container binds fixed host ports, stopping old container first",
+			container.Name)
+
+		_, err = stopWithHooks(client, container, r.oldID, rolloutStopTimeout)
+		r.stoppedOld = true
+		if err != nil {
+			return fmt.Errorf("Error stopping old container: %s", err)
+		}
+	}
+
+	created, err := createContainerAs(client, container, name)
+	if err != nil {
+		return fmt.Errorf("Error creating replacement: %s", err)
+	}
+	r.newID = created.ID
+
+	// The replacement doesn't have the container's name yet, so its hooks
+	// are given its ID.
+	err = startWithHooks(client, container, r.newID)
+	if err != nil {
+		return fmt.Errorf("Error starting replacement: %s", err)
+	}
+
+	log.Infof("%s: Started replacement (id = %s)", container.Name, shortID(r.newID))
+	return nil
+}
+
+// Removes the replacements in a batch, restoring the old containers.
+func rollbackBatch(client *docker.Client, reps []*replacement) {
+	for _, r := range reps {
+		if len(r.newID) > 0 {
+			err := client.RemoveContainer(docker.RemoveContainerOptions{ID: r.newID, Force: true})
+			if err != nil {
+				log.Errorf("%s: Error removing replacement: %s", r.container.Name, err)
+			} else {
+				log.Infof("%s: Removed replacement", r.container.Name)
+			}
+		}
+
+		if r.stoppedOld {
+			err := startWithHooks(client, r.container, r.container.DockerName())
+			if err != nil {
+				log.Errorf("%s: Error restarting old container: %s", r.container.Name, err)
+			} else {
+				log.Infof("%s: Restarted old container", r.container.Name)
+			}
+		}
+	}
+}
+
+// Gives the replacement the old container's name, and then removes the old
+// container.  The old container is renamed aside first, so that if renaming
+// the replacement fails, the old container can be put back.
+func finishReplacement(conn *dockerconn.Conn, r *replacement) error {
+	client := conn.Client
+	name := r.container.DockerName()
+
+	err := swapReplacement(conn, r)
+	if err != nil {
+		rollbackBatch(client, []*replacement{r})
+		return err
+	}
+
+	err = client.RemoveContainer(docker.RemoveContainerOptions{ID: r.oldID})
+	if err != nil {
+		log.Warnf("%s: Error removing old container (%s_old): %s", r.container.Name, name, err)
+	}
+	return nil
+}
+
+// Stops the old container and swaps the names of the old container and its
+// replacement.  If this fails, the old container has its own name.
+func swapReplacement(conn *dockerconn.Conn, r *replacement) error {
+	client := conn.Client
+	name := r.container.DockerName()
+
+	_, err := stopWithHooks(client, r.container, r.oldID, rolloutStopTimeout)
+	r.stoppedOld = true
+	if err != nil {
+		return fmt.Errorf("Error stopping old container: %s", err)
+	}
+
+	// Remove any old container left over from a previous rollout.
+	err = client.RemoveContainer(docker.RemoveContainerOptions{ID: name + "_old", Force: true})
+	if err == nil {
+		log.Warnf("%s: Removed leftover old container", r.container.Name)
+	} else if _, ok := err.(*docker.NoSuchContainer); !ok {
+		return fmt.Errorf("Error removing leftover old container: %s", err)
+	}
+
+	err = renameContainer(conn, r.oldID, name+"_old")
+	if err != nil {
+		return fmt.Errorf("Error renaming old container: %s", err)
+	}
+
+	err = renameContainer(conn, r.newID, name)
+	if err != nil {
+		rerr := renameContainer(conn, r.oldID, name)
+		if rerr != nil {
+			log.Errorf("%s: Error restoring old container's name: %s", r.container.Name, rerr)
+		}
+		return fmt.Errorf("Error renaming replacement: %s", err)
+	}
+
+	return nil
+}
+
+// Replaces every container in a batch, and returns how many were replaced.
+// If any of them fail, the rest are rolled back, but those already replaced
+// are left in place.
+func rolloutBatch(conn *dockerconn.Conn, batch []*Container, oldIDs map[string]string) (int, error) {
+	client := conn.Client
+
+	reps := []*replacement{}
+
+	for _, c := range batch {
+		r := &replacement{container: c, oldID: oldIDs[c.Name]}
+		reps = append(reps, r)
+
+		err := startReplacement(client, r)
+		if err != nil {
+			rollbackBatch(client, reps)
+			return 0, fmt.Errorf("%s: %s", c.Name, err)
+		}
+	}
+
+	// Wait for every replacement to become ready.
+	var wg sync.WaitGroup
+	for _, r := range reps {
+		wg.Add(1)
+		go func(r *replacement) {
+			defer wg.Done()
+			r.err = waitReady(client, r.container, r.newID, flagReadyDelay, flagReadyTimeout)
+		}(r)
+	}
+	wg.Wait()
+
+	for _, r := range reps {
+		if r.err != nil {
+			rollbackBatch(client, reps)
+			return 0, fmt.Errorf("%s: Replacement is not ready: %s", r.container.Name, r.err)
+		}
+		log.Infof("%s: Replacement is ready", r.container.Name)
+	}
+
+	for i, r := range reps {
+		err := finishReplacement(conn, r)
+		if err != nil {
+			rollbackBatch(client, reps[i+1:])
+			return i, fmt.Errorf("%s: %s", r.container.Name, err)
+		}
+		log.Infof("%s: Replaced container", r.container.Name)
+	}
+
+	return len(reps), nil
+}
+
+func cmdRollout(config *Config) (err error) {
+	conn, err := connect()
+	if err != nil {
+		return err
+	}
+	client := conn.Client
+
+	// Find all containers that are using an outdated image.
+	changed := []*Container{}
+	isChanged := make(map[string]bool)
+	oldIDs := make(map[string]string)
+
+	for _, idx := range config.ContainerSort {
+		container := config.Containers[idx]
+
+		oldID, ok, err := checkImageChanged(client, container)
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				log.Warnf("%s: Container not found, skipping...", container.Name)
+				continue
+			}
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
+		if !ok {
+			log.Infof("%s: Image is unchanged, skipping...", container.Name)
+			continue
+		}
+
+		log.Infof("%s: Image has changed", container.Name)
+		changed = append(changed, container)
+		isChanged[container.Name] = true
+		oldIDs[container.Name] = oldID
+	}
+
+	if len(changed) == 0 {
+		log.Infof("Nothing to roll out")
+		return nil
+	}
+
+	// Anything replaced before a failure makes it a partial success.
+	replaced := 0
+	defer func() { err = exitcode.PartialError(replaced, err) }()
+
+	batches := rolloutBatches(changed, flagMaxUnavailable)
+	for i, batch := range batches {
+		names := []string{}
+		for _, c := range batch {
+			names = append(names, c.Name)
+		}
+		log.Infof("Rolling out batch %d/%d: %s", i+1, len(batches), strings.Join(names, ", "))
+
+		var n int
+		n, err = rolloutBatch(conn, batch, oldIDs)
+		replaced += n
+		if err != nil {
+			return fmt.Errorf("Rollout halted after %d of %d batches: %s", i, len(batches), err)
+		}
+
+		// Anything that links to the replaced containers has a stale link.
+		// Containers that are being replaced later will get a fresh link
+		// anyway, so we only restart the others.
+		restarted := make(map[string]bool)
+		for _, c := range batch {
+			for _, dep := range dependentsOf(config, c.Name) {
+				if isChanged[dep.Name] || restarted[dep.Name] {
+					continue
+				}
+				restarted[dep.Name] = true
+
+				inspect, err := client.InspectContainer(dep.DockerName())
+				if err != nil || !inspect.State.Running {
+					continue
+				}
+
+				_, err = stopWithHooks(client, dep, inspect.ID, rolloutStopTimeout)
+				if err == nil {
+					err = startWithHooks(client, dep, inspect.ID)
+				}
+				if err != nil {
+					return fmt.Errorf("%s: Error restarting dependent: %s", dep.Name, err)
+				}
+				log.Infof("%s: Restarted dependent container", dep.Name)
+			}
+		}
+	}
+
+	log.Infof("Finished rolling out containers")
+	log.Infof("Total: %d (%d replaced / %d unchanged)",
+		len(config.Containers), len(changed), len(config.Containers)-len(changed))
+
+	return nil
+}
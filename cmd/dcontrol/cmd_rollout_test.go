@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/exitcode"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func batchNames(batches [][]*Container) [][]string {
+	ret := [][]string{}
+	for _, batch := range batches {
+		names := []string{}
+		for _, c := range batch {
+			names = append(names, c.Name)
+		}
+		ret = append(ret, names)
+	}
+	return ret
+}
+
+func TestRolloutBatches(t *testing.T) {
+	t.Parallel()
+
+	containers := []*Container{
+		{Name: "db"},
+		{Name: "cache"},
+		{Name: "app", Dependencies: []DepConfig{{"db", "db", false}}},
+		{Name: "worker"},
+		{Name: "web", Dependencies: []DepConfig{{"app", "app", false}}},
+	}
+
+	assert.Equal(t, batchNames(rolloutBatches(containers, 1)), [][]string{
+		{"db"}, {"cache"}, {"app"}, {"worker"}, {"web"},
+	})
+	assert.Equal(t, batchNames(rolloutBatches(containers, 0)), [][]string{
+		{"db"}, {"cache"}, {"app"}, {"worker"}, {"web"},
+	})
+	assert.Equal(t, batchNames(rolloutBatches(containers, 3)), [][]string{
+		{"db", "cache"}, {"app", "worker"}, {"web"},
+	})
+	assert.Equal(t, batchNames(rolloutBatches(containers, 10)), [][]string{
+		{"db", "cache"}, {"app", "worker"}, {"web"},
+	})
+}
+
+func TestHasFixedHostPorts(t *testing.T) {
+	t.Parallel()
+
+	assert.False(t, hasFixedHostPorts(&Container{}))
+	assert.False(t, hasFixedHostPorts(&Container{
+		Ports: []PortConfig{{"0.0.0.0", 0, 80}},
+	}))
+	assert.True(t, hasFixedHostPorts(&Container{
+		Ports: []PortConfig{{"0.0.0.0", 0, 80}, {"0.0.0.0", 443, 443}},
+	}))
+}
+
+func TestWaitReady(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	id := s.runContainer(t)
+	container := &Container{Name: id, Image: "busybox"}
+
+	err := waitReady(s.client, container, id, 0, time.Second)
+	assert.NoError(t, err)
+
+	err = s.client.StopContainer(id, 0)
+	assert.NoError(t, err)
+
+	err = waitReady(s.client, container, id, 0, time.Second)
+	assert.EqualError(t, err, "Container exited with code 0")
+}
+
+func TestRenameContainer(t *testing.T) {
+	t.Parallel()
+
+	var path, query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		query = r.URL.RawQuery
+
+		if strings.Contains(path, "missing") {
+			http.Error(w, "No such container", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	conn, err := dockerconn.New(dockerconn.Options{
+		Endpoint: strings.Replace(server.URL, "http://", "tcp://", 1),
+	})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	err = renameContainer(conn, "abcdef", "myapp_db")
+	assert.NoError(t, err)
+	assert.Equal(t, path, "/containers/abcdef/rename")
+	assert.Equal(t, query, "name=myapp_db")
+
+	err = renameContainer(conn, "missing", "myapp_db")
+	assert.EqualError(t, err, "API error (404): No such container\n")
+}
+
+// A fake Docker server that, unlike the one from go-dockerclient, supports
+// container names and renaming, which rollouts rely on.
+type fakeDocker struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	images     map[string]string
+	containers []*docker.Container
+	starts     map[string]int
+	nextID     int
+
+	// Renaming the container with this name fails.
+	failRename string
+}
+
+func newFakeDocker() *fakeDocker {
+	f := &fakeDocker{
+		images: make(map[string]string),
+		starts: make(map[string]int),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeDocker) endpoint() string {
+	return strings.Replace(f.URL, "http://", "tcp://", 1)
+}
+
+// Adds a running container with the given name and image.
+func (f *fakeDocker) run(name, image string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.create(name, image)
+	c.State.Running = true
+	return c.ID
+}
+
+func (f *fakeDocker) create(name, image string) *docker.Container {
+	f.nextID++
+	c := &docker.Container{
+		ID:    fmt.Sprintf("%064d", f.nextID),
+		Name:  "/" + name,
+		Image: f.images[image],
+	}
+	f.containers = append(f.containers, c)
+	return c
+}
+
+// Returns the container with the given ID or name.
+func (f *fakeDocker) find(ref string) (int, *docker.Container) {
+	for i, c := range f.containers {
+		if c.ID == ref || c.Name == "/"+ref {
+			return i, c
+		}
+	}
+	return -1, nil
+}
+
+// Returns a copy of the container with the given name, or nil.
+func (f *fakeDocker) inspect(name string) *docker.Container {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, c := f.find(name)
+	if c == nil {
+		return nil
+	}
+	ret := *c
+	return &ret
+}
+
+func (f *fakeDocker) startCount(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.starts[id]
+}
+
+func (f *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/_ping":
+		w.Write([]byte("OK"))
+		return
+
+	case parts[0] == "images" && len(parts) == 3 && parts[2] == "json":
+		if id, ok := f.images[parts[1]]; ok {
+			json.NewEncoder(w).Encode(&docker.Image{ID: id})
+			return
+		}
+
+	case r.URL.Path == "/containers/create":
+		var config docker.Config
+		json.NewDecoder(r.Body).Decode(&config)
+		name := r.URL.Query().Get("name")
+		if _, c := f.find(name); c != nil {
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f.create(name, config.Image))
+		return
+
+	case parts[0] == "containers" && len(parts) >= 2:
+		i, c := f.find(parts[1])
+		if c == nil {
+			break
+		}
+
+		action := ""
+		if len(parts) > 2 {
+			action = parts[2]
+		}
+		switch {
+		case r.Method == "GET" && action == "json":
+			json.NewEncoder(w).Encode(c)
+		case action == "start":
+			c.State.Running = true
+			f.starts[c.ID]++
+			w.WriteHeader(http.StatusNoContent)
+		case action == "stop":
+			if !c.State.Running {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			c.State.Running = false
+			w.WriteHeader(http.StatusNoContent)
+		case action == "rename":
+			name := r.URL.Query().Get("name")
+			if _, other := f.find(name); other != nil || c.Name == "/"+f.failRename {
+				http.Error(w, "Conflict", http.StatusConflict)
+				return
+			}
+			c.Name = "/" + name
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "DELETE":
+			if c.State.Running && r.URL.Query().Get("force") != "1" {
+				http.Error(w, "Container is running", http.StatusConflict)
+				return
+			}
+			f.containers = append(f.containers[:i], f.containers[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Unsupported", http.StatusBadRequest)
+		}
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// Sets up a cluster where the db's image has been updated, and the app, which
+// depends on it, is unchanged.  Returns the IDs of the running containers.
+func setupRollout(f *fakeDocker) (*Config, string, string) {
+	f.images["db"] = "db-v1"
+	f.images["app"] = "app-v1"
+	db := f.run("test_db", "db")
+	app := f.run("test_app", "app")
+	f.images["db"] = "db-v2"
+
+	flagDocker = dockerconn.Options{Endpoint: f.endpoint()}
+	flagMaxUnavailable = 1
+	flagReadyDelay = 0
+	flagReadyTimeout = 0
+
+	config := &Config{
+		Project: "test",
+		Containers: []*Container{
+			{Name: "db", Project: "test", Image: "db"},
+			{Name: "app", Project: "test", Image: "app",
+				Dependencies: []DepConfig{{"db", "db", false}}},
+		},
+		ContainerSort: []int{0, 1},
+	}
+	return config, db, app
+}
+
+func TestRollout(t *testing.T) {
+	f := newFakeDocker()
+	defer f.Close()
+	config, db, app := setupRollout(f)
+
+	err := cmdRollout(config)
+	assert.NoError(t, err)
+
+	replaced := f.inspect("test_db")
+	if assert.NotNil(t, replaced) {
+		assert.NotEqual(t, replaced.ID, db)
+		assert.Equal(t, replaced.Image, "db-v2")
+		assert.True(t, replaced.State.Running)
+	}
+	assert.Nil(t, f.inspect(db))
+	assert.Nil(t, f.inspect("test_db_next"))
+	assert.Nil(t, f.inspect("test_db_old"))
+
+	// The app has a stale link to the db, so it's restarted.
+	assert.Equal(t, f.startCount(app), 1)
+	assert.True(t, f.inspect("test_app").State.Running)
+}
+
+func TestRolloutRenameFailure(t *testing.T) {
+	f := newFakeDocker()
+	defer f.Close()
+	config, db, app := setupRollout(f)
+	f.failRename = "test_db_next"
+
+	err := cmdRollout(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Rollout halted after 0 of 1 batches: db: Error renaming replacement")
+	}
+	assert.Equal(t, exitcode.Of(err), exitFailure)
+
+	// The old container is back, under its own name.
+	old := f.inspect("test_db")
+	if assert.NotNil(t, old) {
+		assert.Equal(t, old.ID, db)
+		assert.True(t, old.State.Running)
+	}
+	assert.Nil(t, f.inspect("test_db_next"))
+	assert.Nil(t, f.inspect("test_db_old"))
+	assert.Equal(t, f.startCount(app), 0)
+}
+
+func TestRolloutPartialBatch(t *testing.T) {
+	f := newFakeDocker()
+	defer f.Close()
+	config, db, _ := setupRollout(f)
+
+	// The db and a cache are replaced in the same batch, and the cache
+	// can't be renamed into place after the db has been.
+	f.images["cache"] = "cache-v1"
+	cache := f.run("test_cache", "cache")
+	f.images["cache"] = "cache-v2"
+	config.Containers = append(config.Containers, &Container{Name: "cache", Project: "test", Image: "cache"})
+	config.ContainerSort = []int{0, 2, 1}
+	flagMaxUnavailable = 2
+	f.failRename = "test_cache_next"
+
+	err := cmdRollout(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cache: Error renaming replacement")
+	}
+	assert.Equal(t, exitcode.Of(err), exitPartial)
+
+	replaced := f.inspect("test_db")
+	if assert.NotNil(t, replaced) {
+		assert.NotEqual(t, replaced.ID, db)
+	}
+	old := f.inspect("test_cache")
+	if assert.NotNil(t, old) {
+		assert.Equal(t, old.ID, cache)
+		assert.True(t, old.State.Running)
+	}
+}
+
+func TestRolloutNotReady(t *testing.T) {
+	f := newFakeDocker()
+	defer f.Close()
+	config, db, _ := setupRollout(f)
+
+	// The fake server never gives containers an address, so this port is
+	// never ready.
+	config.Containers[0].ReadyPort = 5432
+
+	err := cmdRollout(config)
+	assert.Error(t, err)
+
+	old := f.inspect("test_db")
+	if assert.NotNil(t, old) {
+		assert.Equal(t, old.ID, db)
+		assert.True(t, old.State.Running)
+	}
+	assert.Nil(t, f.inspect("test_db_next"))
+}
+
+func TestRolloutHooks(t *testing.T) {
+	f := newFakeDocker()
+	defer f.Close()
+	config, _, _ := setupRollout(f)
+
+	dir, err := ioutil.TempDir("", "dcontrol-hooks")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	hook := []HookConfig{{Command: "echo $DCONTROL_HOOK $DCONTROL_CONTAINER_NAME >> " + out}}
+	config.Containers[0].Hooks = HooksConfig{
+		PreStart:  hook,
+		PostStart: hook,
+		PreStop:   hook,
+		PostStop:  hook,
+	}
+
+	err = cmdRollout(config)
+	assert.NoError(t, err)
+
+	// The replacement is started before the old container is stopped.
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Split(strings.TrimSpace(string(data)), "\n"), []string{
+		"pre_start test_db_next",
+		"post_start test_db_next",
+		"pre_stop test_db",
+		"post_stop test_db",
+	})
+}
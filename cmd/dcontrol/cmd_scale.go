@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrew-d/docker-tools/exitcode"
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// How long to wait for a removed instance to stop before Docker kills it.
+const scaleStopTimeout = 10
+
+// If the given Docker container name is an instance of the scaled container
+// with the given prefix, returns the instance number.
+func parseInstanceName(name, prefix string) (int, bool) {
+	name = strings.TrimPrefix(name, "/")
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+
+	instance, err := strconv.Atoi(name[len(prefix):])
+	if err != nil || instance < 1 {
+		return 0, false
+	}
+	return instance, true
+}
+
+func cmdScale(config *Config, name string, count int) (err error) {
+	if count < 1 {
+		return exitcode.Errorf(exitUsage, "Scale must be at least 1: %d", count)
+	}
+
+	// Find the first instance of this container, which we use as a template
+	// for all other instances.
+	var tmpl *Container
+	for _, c := range config.Containers {
+		if c.Base == name && c.Instance == 1 {
+			tmpl = c
+			break
+		}
+		if c.Name == name {
+			return exitcode.Errorf(exitUsage, "%s: Container is not scaled (add a 'scale' key to the config)", name)
+		}
+	}
+	if tmpl == nil {
+		return exitcode.Errorf(exitUsage, "Unknown container: %s", name)
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+
+	created := 0
+	started := 0
+	removed := 0
+
+	// Anything changed before a failure makes it a partial success.
+	defer func() { err = exitcode.PartialError(created+started+removed, err) }()
+
+	// Create and start all instances up to the requested count.
+	for i := 1; i <= count; i++ {
+		container := instanceOf(tmpl, i)
+
+		exists, err := checkContainerExists(client, container)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
+		if !exists {
+			err = createContainer(client, container)
+			if err != nil {
+				return fmt.Errorf("%s: Error creating: %s", container.Name, err)
+			}
+			log.Infof("%s: Created container", container.Name)
+			created++
+		}
+
+		inspect, err := client.InspectContainer(container.DockerName())
+		if err != nil {
+			return fmt.Errorf("%s: Error inspecting container: %s", container.Name, err)
+		}
+		if inspect.State.Running {
+			continue
+		}
+
+		err = startWithHooks(client, container, inspect.ID)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
+		log.Infof("%s: Started container", container.Name)
+		started++
+	}
+
+	// Find all instances above the requested count.
+	all, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("Error listing containers: %s", err)
+	}
+
+	prefix := dockerName(tmpl.Project, tmpl.Base) + "_"
+	extra := []int{}
+	for _, c := range all {
+		for _, n := range c.Names {
+			if instance, ok := parseInstanceName(n, prefix); ok && instance > count {
+				extra = append(extra, instance)
+			}
+		}
+	}
+
+	// Remove them, starting with the highest.
+	sort.Sort(sort.Reverse(sort.IntSlice(extra)))
+	for _, i := range extra {
+		container := instanceOf(tmpl, i)
+
+		inspect, err := client.InspectContainer(container.DockerName())
+		if err != nil {
+			return fmt.Errorf("%s: Error inspecting container: %s", container.Name, err)
+		}
+
+		stopped, err := stopWithHooks(client, container, inspect.ID, scaleStopTimeout)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
+		if stopped {
+			log.Infof("%s: Stopped container", container.Name)
+		}
+
+		err = client.RemoveContainer(docker.RemoveContainerOptions{ID: inspect.ID})
+		if err != nil {
+			return fmt.Errorf("%s: Error removing: %s", container.Name, err)
+		}
+		log.Infof("%s: Removed container", container.Name)
+		removed++
+	}
+
+	// Containers that link to all instances won't see the change until
+	// they're restarted.
+	for _, c := range config.Containers {
+		for _, dep := range c.Dependencies {
+			if _, ok := parseInstanceName(dep.Name, tmpl.Base+"_"); ok && dep.All {
+				log.Warnf("%s: Links to all instances of %s, and must be restarted",
+					c.Name, name)
+				break
+			}
+		}
+	}
+
+	if count != tmpl.Scale {
+		log.Warnf("%s: Config file has 'scale: %d', remember to update it to %d",
+			name, tmpl.Scale, count)
+	}
+
+	log.Infof("Finished scaling %s to %d", name, count)
+	log.Infof("Total: %d created / %d started / %d removed", created, started, removed)
+
+	return nil
+}
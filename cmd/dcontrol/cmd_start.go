@@ -3,41 +3,81 @@ package main
 import (
 	"fmt"
 
+	"github.com/andrew-d/docker-tools/exitcode"
 	"github.com/andrew-d/docker-tools/log"
 	"github.com/fsouza/go-dockerclient"
 )
 
-func cmdStart(config *Config) {
+// Build the host configuration used when starting a container.
+func buildHostConfig(container *Container) *docker.HostConfig {
+	opts := &docker.HostConfig{
+		Privileged:   container.Privileged,
+		PortBindings: make(map[docker.Port][]docker.PortBinding),
+	}
+
+	for _, port := range container.Ports {
+		dport := docker.Port(fmt.Sprintf("%d/tcp", port.ContainerPort))
+		binding := docker.PortBinding{HostIp: port.IP}
+
+		// A host port of 0 means that Docker will choose one for us.
+		if port.HostPort != 0 {
+			binding.HostPort = fmt.Sprintf("%d", port.HostPort)
+		}
+
+		opts.PortBindings[dport] = append(opts.PortBindings[dport], binding)
+	}
+	for _, mount := range container.Mount {
+		bind := mount.HostDir + ":" + mount.ContainerDir
+
+		// TODO: read/write?
+
+		opts.Binds = append(opts.Binds, bind)
+	}
+	for _, mfrom := range container.MountFrom {
+		opts.VolumesFrom = append(opts.VolumesFrom, dockerName(container.Project, mfrom))
+	}
+	for _, dep := range container.Dependencies {
+		opts.Links = append(opts.Links, fmt.Sprintf("%s:%s",
+			dockerName(container.Project, dep.Name), dep.Alias))
+	}
+
+	return opts
+}
+
+func startContainer(client *docker.Client, container *Container) error {
+	return client.StartContainer(container.DockerName(), buildHostConfig(container))
+}
+
+func cmdStart(config *Config) (err error) {
 	client, err := getClient()
 	if err != nil {
-		log.Errorf("Error getting client: %s", err)
-		return
+		return err
 	}
 
 	started := 0
 	skipped := 0
 
+	// Anything started before a failure makes it a partial success.
+	defer func() { err = exitcode.PartialError(started, err) }()
+
 	for _, idx := range config.ContainerSort {
 		container := config.Containers[idx]
 
 		// Check if the container exists.
 		exists, err := checkContainerExists(client, container)
 		if err != nil {
-			log.Errorf("%s: %s", container.Name, err)
-			return
+			return fmt.Errorf("%s: %s", container.Name, err)
 		} else if exists {
 			log.Infof("%s: Container exists", container.Name)
 		} else {
-			log.Errorf("%s: Container not found, did you run `dcontrol create`?",
+			return fmt.Errorf("%s: Container not found, did you run `dcontrol create`?",
 				container.Name)
-			return
 		}
 
 		// Check if the container is started.
-		inspect, err := client.InspectContainer(container.Name)
+		inspect, err := client.InspectContainer(container.DockerName())
 		if err != nil {
-			log.Errorf("%s: Error inspecting container: %s", container.Name, err)
-			return
+			return fmt.Errorf("%s: Error inspecting container: %s", container.Name, err)
 		}
 		if inspect.State.Running {
 			log.Infof("%s: Container is already running, skipping...", container.Name)
@@ -45,43 +85,28 @@ func cmdStart(config *Config) {
 			continue
 		}
 
-		// Build options
-		opts := &docker.HostConfig{
-			Privileged: container.Privileged,
-		}
-
-		for _, port := range container.Ports {
-			dport := docker.Port(fmt.Sprintf("%d/tcp", port.ContainerPort))
-			opts.PortBindings[dport] = append(opts.PortBindings[dport], docker.PortBinding{
-				HostIp:   port.IP,
-				HostPort: fmt.Sprintf("%d", port.HostPort),
-			})
-		}
-		for _, mount := range container.Mount {
-			bind := mount.HostDir + ":" + mount.ContainerDir
-
-			// TODO: read/write?
-
-			opts.Binds = append(opts.Binds, bind)
-		}
-		for _, mfrom := range container.MountFrom {
-			opts.VolumesFrom = append(opts.VolumesFrom, mfrom)
-		}
-		for _, dep := range container.Dependencies {
-			opts.Links = append(opts.Links, fmt.Sprintf("%s:%s", dep.Name, dep.Alias))
+		err = runHooks(client, container, "pre_start", container.Hooks.PreStart)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
 		}
 
-		err = client.StartContainer(container.Name, opts)
+		err = startContainer(client, container)
 		if err != nil {
-			log.Errorf("%s: Error starting: %s", container.Name, err)
-			return
+			return fmt.Errorf("%s: Error starting: %s", container.Name, err)
 		}
 
 		log.Infof("%s: Started container", container.Name)
 		started++
+
+		err = runHooks(client, container, "post_start", container.Hooks.PostStart)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
 	}
 
 	log.Infof("Finished starting containers")
 	log.Infof("Total: %d (%d started / %d skipped)",
 		len(config.Containers), started, skipped)
+
+	return nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func cmdStatus(config *Config) error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCONTAINER\tID\tSTATUS\tIP")
+
+	for _, idx := range config.ContainerSort {
+		container := config.Containers[idx]
+
+		inspect, err := client.InspectContainer(container.DockerName())
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				fmt.Fprintf(w, "%s\t%s\t-\tNot created\t-\n",
+					container.Name, container.DockerName())
+				continue
+			}
+
+			w.Flush()
+			return fmt.Errorf("%s: Error inspecting container: %s", container.Name, err)
+		}
+
+		ip := "-"
+		if inspect.State.Running && inspect.NetworkSettings != nil {
+			ip = inspect.NetworkSettings.IPAddress
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			container.Name, container.DockerName(), shortID(inspect.ID),
+			inspect.State.String(), ip)
+	}
+
+	w.Flush()
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/andrew-d/docker-tools/exitcode"
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// How long to wait for a container to stop before Docker kills it.
+const stopTimeout = 10
+
+func cmdStop(config *Config) (err error) {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+
+	stopped := 0
+	skipped := 0
+
+	// Anything stopped before a failure makes it a partial success.
+	defer func() { err = exitcode.PartialError(stopped, err) }()
+
+	// Stop containers in the reverse order that we start them, so nothing is
+	// left running with a link to a stopped container.
+	for i := len(config.ContainerSort) - 1; i >= 0; i-- {
+		container := config.Containers[config.ContainerSort[i]]
+
+		inspect, err := client.InspectContainer(container.DockerName())
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				log.Infof("%s: Container not found, skipping...", container.Name)
+				skipped++
+				continue
+			}
+
+			return fmt.Errorf("%s: Error inspecting container: %s", container.Name, err)
+		}
+		if !inspect.State.Running {
+			log.Infof("%s: Container is not running, skipping...", container.Name)
+			skipped++
+			continue
+		}
+
+		err = runHooks(client, container, "pre_stop", container.Hooks.PreStop)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
+
+		err = client.StopContainer(container.DockerName(), stopTimeout)
+		if err != nil {
+			return fmt.Errorf("%s: Error stopping: %s", container.Name, err)
+		}
+
+		log.Infof("%s: Stopped container", container.Name)
+		stopped++
+
+		err = runHooks(client, container, "post_stop", container.Hooks.PostStop)
+		if err != nil {
+			return fmt.Errorf("%s: %s", container.Name, err)
+		}
+	}
+
+	log.Infof("Finished stopping containers")
+	log.Infof("Total: %d (%d stopped / %d skipped)",
+		len(config.Containers), stopped, skipped)
+
+	return nil
+}
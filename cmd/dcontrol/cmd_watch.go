@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// How long to wait for a dependent container to stop before Docker kills it.
+const watchStopTimeout = 10
+
+// A watchMember tracks the supervision state of a single container.
+type watchMember struct {
+	container *Container
+	id        string
+
+	// Restart bookkeeping.
+	attempts  int
+	lastStart time.Time
+	timer     *time.Timer
+
+	// Set while we are restarting this container ourselves, so that the
+	// resulting 'die' and 'stop' events are not treated as a crash.  It's
+	// cleared when our 'stop' event arrives, even if starting the container
+	// again failed.
+	restarting bool
+}
+
+// Watcher subscribes to the Docker event stream and restarts containers in a
+// cluster when they die.
+type Watcher struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	conn    *dockerconn.Conn
+	client  *docker.Client
+	config  *Config
+	members map[string]*watchMember
+	restart chan *watchMember
+	stop    <-chan struct{}
+}
+
+func NewWatcher(conn *dockerconn.Conn, config *Config) *Watcher {
+	ret := &Watcher{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+
+		conn:    conn,
+		client:  conn.Client,
+		config:  config,
+		members: make(map[string]*watchMember),
+		restart: make(chan *watchMember),
+	}
+	return ret
+}
+
+// Run watches the cluster until the stop channel is closed.  Note that
+// containers must already exist - containers that are created after we start
+// watching are not supervised.
+func (w *Watcher) Run(stop <-chan struct{}) error {
+	w.stop = stop
+
+	for _, idx := range w.config.ContainerSort {
+		container := w.config.Containers[idx]
+
+		inspect, err := w.client.InspectContainer(container.DockerName())
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				log.Warnf("%s: Container not found, not watching", container.Name)
+				continue
+			}
+			return err
+		}
+
+		w.members[inspect.ID] = &watchMember{
+			container: container,
+			id:        inspect.ID,
+			lastStart: inspect.State.StartedAt,
+		}
+		log.Infof("%s: Watching container (id = %s)", container.Name, shortID(inspect.ID))
+	}
+
+	events := make(chan *docker.APIEvents, 16)
+	err := w.conn.Events(events, stop)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Listening for events...")
+
+	for {
+		select {
+		case ev := <-events:
+			w.handleEvent(ev)
+
+		case m := <-w.restart:
+			w.restartMember(m)
+
+		case <-stop:
+			for _, m := range w.members {
+				if m.timer != nil {
+					m.timer.Stop()
+				}
+			}
+			return nil
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(ev *docker.APIEvents) {
+	m, ok := w.members[ev.ID]
+	if !ok {
+		return
+	}
+
+	log.Debugf("%s: Got event: %s", m.container.Name, ev.Status)
+
+	switch ev.Status {
+	case "die":
+		if m.restarting || m.timer != nil {
+			return
+		}
+		w.scheduleRestart(m)
+
+	case "stop":
+		// Docker sends 'die' followed by 'stop' when a container is stopped
+		// on purpose, so we cancel any pending restart - unless we stopped
+		// it ourselves, in which case the restart is a retry.
+		if m.restarting {
+			m.restarting = false
+			return
+		}
+		if m.timer == nil {
+			return
+		}
+		m.timer.Stop()
+		m.timer = nil
+		log.Infof("%s: Container was stopped, not restarting", m.container.Name)
+
+	case "start":
+		m.restarting = false
+		m.lastStart = time.Now()
+
+	case "destroy":
+		if m.timer != nil {
+			m.timer.Stop()
+		}
+		delete(w.members, ev.ID)
+		log.Warnf("%s: Container was removed, no longer watching", m.container.Name)
+	}
+}
+
+func (w *Watcher) scheduleRestart(m *watchMember) {
+	// If the container stayed up for longer than our maximum backoff, then
+	// we consider it to have recovered and start counting again.
+	if time.Since(m.lastStart) > w.MaxBackoff {
+		m.attempts = 0
+	}
+
+	delay := nextBackoff(w.InitialBackoff, w.MaxBackoff, m.attempts)
+	m.attempts++
+
+	log.Warnf("%s: Container died, restarting in %s (attempt %d)",
+		m.container.Name, delay, m.attempts)
+
+	m.timer = time.AfterFunc(delay, func() {
+		select {
+		case w.restart <- m:
+		case <-w.stop:
+		}
+	})
+}
+
+func (w *Watcher) restartMember(m *watchMember) {
+	m.timer = nil
+
+	// The container may have been removed while we were waiting.
+	if _, ok := w.members[m.id]; !ok {
+		return
+	}
+
+	inspect, err := w.client.InspectContainer(m.id)
+	if err != nil {
+		log.Errorf("%s: Error inspecting container: %s", m.container.Name, err)
+		w.scheduleRestart(m)
+		return
+	}
+
+	if inspect.State.Running {
+		log.Infof("%s: Container is already running, skipping restart", m.container.Name)
+	} else {
+		err = startWithHooks(w.client, m.container, m.id)
+		if err != nil {
+			log.Errorf("%s: Error restarting: %s", m.container.Name, err)
+			w.scheduleRestart(m)
+			return
+		}
+		log.Infof("%s: Restarted container", m.container.Name)
+	}
+
+	// Since links are resolved when a container is started, everything that
+	// links to this container now has a stale link and needs a restart.
+	for _, dep := range dependentsOf(w.config, m.container.Name) {
+		dm := w.memberByName(dep.Name)
+		if dm == nil || dm.timer != nil {
+			continue
+		}
+
+		inspect, err := w.client.InspectContainer(dm.id)
+		if err != nil {
+			log.Errorf("%s: Error inspecting container: %s", dep.Name, err)
+			continue
+		}
+		if !inspect.State.Running {
+			log.Infof("%s: Dependent container is not running, skipping", dep.Name)
+			continue
+		}
+
+		log.Infof("%s: Restarting dependent of %s", dep.Name, m.container.Name)
+
+		// If the container wasn't stopped, there won't be any events for us
+		// to ignore.
+		dm.restarting = true
+		stopped, err := stopWithHooks(w.client, dep, dm.id, watchStopTimeout)
+		dm.restarting = stopped
+		if err == nil {
+			err = startWithHooks(w.client, dep, dm.id)
+		}
+		if err != nil {
+			log.Errorf("%s: Error restarting dependent: %s", dep.Name, err)
+			w.scheduleRestart(dm)
+			continue
+		}
+
+		log.Infof("%s: Restarted dependent container", dep.Name)
+	}
+}
+
+func (w *Watcher) memberByName(name string) *watchMember {
+	for _, m := range w.members {
+		if m.container.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns the delay before the given (zero-based) restart attempt.  The delay
+// doubles with each attempt, up to the given maximum.
+func nextBackoff(initial, max time.Duration, attempt int) time.Duration {
+	delay := initial
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Returns all containers that transitively depend on the named container, in
+// the order they should be started.
+func dependentsOf(config *Config, name string) []*Container {
+	affected := map[string]bool{name: true}
+	ret := []*Container{}
+
+	for _, idx := range config.ContainerSort {
+		container := config.Containers[idx]
+
+		for _, dep := range container.Dependencies {
+			if affected[dep.Name] {
+				affected[container.Name] = true
+				ret = append(ret, container)
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func cmdWatch(config *Config) error {
+	conn, err := connect()
+	if err != nil {
+		return err
+	}
+
+	w := NewWatcher(conn, config)
+	w.InitialBackoff = flagBackoff
+	w.MaxBackoff = flagMaxBackoff
+
+	names := []string{}
+	for _, idx := range config.ContainerSort {
+		names = append(names, config.Containers[idx].Name)
+	}
+	log.Infof("Watching containers: %s", strings.Join(names, ", "))
+
+	// Note: we never close this, so we will run until killed.
+	stop := make(chan struct{})
+	err = w.Run(stop)
+	if err != nil {
+		return fmt.Errorf("Error watching containers: %s", err)
+	}
+
+	return nil
+}
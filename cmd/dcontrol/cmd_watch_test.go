@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake Docker server, along with a channel to send events on, and a record
+// of all the requests that were made.
+type testServer struct {
+	*dtesting.DockerServer
+	conn   *dockerconn.Conn
+	client *docker.Client
+	events chan *docker.APIEvents
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ret := &testServer{
+		events: make(chan *docker.APIEvents),
+	}
+
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, func(r *http.Request) {
+		ret.mu.Lock()
+		ret.requests = append(ret.requests, r.Method+" "+r.URL.Path)
+		ret.mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Error starting fake server: %s", err)
+	}
+	ret.DockerServer = server
+
+	// The fake server's event stream is random, so we replace it with one
+	// that sends the events we give it.
+	server.CustomHandler("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		enc := json.NewEncoder(w)
+		for ev := range ret.events {
+			enc.Encode(ev)
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	ret.conn, err = dockerconn.New(dockerconn.Options{Endpoint: server.URL()})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+	ret.client = ret.conn.Client
+
+	err = ret.client.PullImage(docker.PullImageOptions{Repository: "busybox"},
+		docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatalf("Error pulling image: %s", err)
+	}
+
+	return ret
+}
+
+func (s *testServer) Close() {
+	close(s.events)
+	s.Stop()
+}
+
+// Creates and starts a container, returning its ID.  Note that the fake
+// server does not support container names, so the container's name in the
+// config must be this ID.
+func (s *testServer) runContainer(t *testing.T) string {
+	c, err := s.client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: "busybox"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating container: %s", err)
+	}
+
+	err = s.client.StartContainer(c.ID, &docker.HostConfig{})
+	if err != nil {
+		t.Fatalf("Error starting container: %s", err)
+	}
+
+	return c.ID
+}
+
+func (s *testServer) sendEvent(id, status string) {
+	s.events <- &docker.APIEvents{
+		ID:     id,
+		Status: status,
+		From:   "busybox",
+		Time:   time.Now().Unix(),
+	}
+}
+
+func (s *testServer) isRunning(t *testing.T, id string) bool {
+	inspect, err := s.client.InspectContainer(id)
+	if err != nil {
+		t.Fatalf("Error inspecting container: %s", err)
+	}
+	return inspect.State.Running
+}
+
+func (s *testServer) countRequests(req string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, r := range s.requests {
+		if strings.HasPrefix(r, req) {
+			count++
+		}
+	}
+	return count
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestCluster(t *testing.T, containers []*Container) *Config {
+	sort, err := TopoSortContainers(containers)
+	if err != nil {
+		t.Fatalf("Error sorting containers: %s", err)
+	}
+
+	return &Config{
+		Containers:    containers,
+		ContainerSort: sort,
+	}
+}
+
+func startWatcher(s *testServer, config *Config) chan struct{} {
+	w := NewWatcher(s.conn, config)
+	w.InitialBackoff = 20 * time.Millisecond
+	w.MaxBackoff = 100 * time.Millisecond
+
+	stop := make(chan struct{})
+	go w.Run(stop)
+	return stop
+}
+
+func TestWatchRestartsDeadContainer(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	db := s.runContainer(t)
+	web := s.runContainer(t)
+	other := s.runContainer(t)
+
+	config := newTestCluster(t, []*Container{
+		{Name: db, Image: "busybox"},
+		{Name: web, Image: "busybox", Dependencies: []DepConfig{{db, "db", false}}},
+		{Name: other, Image: "busybox"},
+	})
+
+	stop := startWatcher(s, config)
+	defer close(stop)
+
+	// Simulate the container crashing.
+	err := s.client.StopContainer(db, 0)
+	assert.NoError(t, err)
+	s.sendEvent(db, "die")
+
+	waitFor(t, "container restart", func() bool {
+		return s.isRunning(t, db)
+	})
+	waitFor(t, "dependent restart", func() bool {
+		return s.countRequests("POST /containers/"+web+"/start") == 2
+	})
+
+	assert.Equal(t, s.countRequests("POST /containers/"+web+"/stop"), 1)
+	assert.True(t, s.isRunning(t, web))
+	assert.Equal(t, s.countRequests("POST /containers/"+other+"/"), 1)
+}
+
+func TestWatchIgnoresStoppedContainer(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	db := s.runContainer(t)
+	config := newTestCluster(t, []*Container{
+		{Name: db, Image: "busybox"},
+	})
+
+	w := NewWatcher(s.conn, config)
+	w.InitialBackoff = 200 * time.Millisecond
+	w.MaxBackoff = time.Second
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.Run(stop)
+
+	// Stopping a container on purpose sends both 'die' and 'stop'.
+	err := s.client.StopContainer(db, 0)
+	assert.NoError(t, err)
+	s.sendEvent(db, "die")
+	time.Sleep(10 * time.Millisecond)
+	s.sendEvent(db, "stop")
+
+	time.Sleep(400 * time.Millisecond)
+	assert.False(t, s.isRunning(t, db))
+	assert.Equal(t, s.countRequests("POST /containers/"+db+"/start"), 1)
+}
+
+func TestWatchRetriesFailedDependentRestart(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	db := s.runContainer(t)
+	web := s.runContainer(t)
+	config := newTestCluster(t, []*Container{
+		{Name: db, Image: "busybox"},
+		{Name: web, Image: "busybox", Dependencies: []DepConfig{{db, "db", false}}},
+	})
+
+	// The first time the dependent is started again, it fails.
+	var (
+		mu     sync.Mutex
+		starts int
+	)
+	s.CustomHandler("/containers/"+web+"/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		starts++
+		n := starts
+		mu.Unlock()
+
+		if n == 1 {
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		s.DefaultHandler().ServeHTTP(w, r)
+	}))
+	startCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return starts
+	}
+
+	w := NewWatcher(s.conn, config)
+	w.InitialBackoff = 200 * time.Millisecond
+	w.MaxBackoff = time.Second
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.Run(stop)
+
+	err := s.client.StopContainer(db, 0)
+	assert.NoError(t, err)
+	s.sendEvent(db, "die")
+
+	waitFor(t, "failed dependent restart", func() bool {
+		return startCount() == 1
+	})
+
+	// The events from stopping the dependent ourselves arrive before the
+	// retry, and mustn't cancel it.
+	s.sendEvent(web, "die")
+	s.sendEvent(web, "stop")
+
+	waitFor(t, "dependent retry", func() bool {
+		return startCount() == 2
+	})
+	assert.True(t, s.isRunning(t, web))
+}
+
+func TestNextBackoff(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Attempt  int
+		Expected time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{5, 32 * time.Second},
+		{6, 60 * time.Second},
+		{100, 60 * time.Second},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, nextBackoff(time.Second, time.Minute, test.Attempt), test.Expected)
+	}
+}
+
+func TestDependentsOf(t *testing.T) {
+	t.Parallel()
+
+	config := newTestCluster(t, []*Container{
+		{Name: "db"},
+		{Name: "cache"},
+		{Name: "app", Dependencies: []DepConfig{{"db", "db", false}, {"cache", "cache", false}}},
+		{Name: "web", Dependencies: []DepConfig{{"app", "app", false}}},
+	})
+
+	names := []string{}
+	for _, c := range dependentsOf(config, "db") {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, names, []string{"app", "web"})
+
+	assert.Empty(t, dependentsOf(config, "web"))
+}
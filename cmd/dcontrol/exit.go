@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/andrew-d/docker-tools/exitcode"
+)
+
+// The codes that dcontrol exits with.  These are documented in the usage
+// message, so they mustn't change.
+const (
+	exitOK         = exitcode.OK
+	exitFailure    = exitcode.Failure    // the command failed, without changing any containers
+	exitUsage      = exitcode.Usage      // invalid arguments
+	exitConfig     = exitcode.Config     // invalid config file
+	exitConnection = exitcode.Connection // can't connect to Docker
+	exitPartial    = exitcode.Partial    // the command failed after changing some containers
+)
+
+// Returned when the arguments are invalid, to show the usage message.
+var errUsage = exitcode.With(exitUsage, errors.New("Invalid arguments"))
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Returns the environment variables that describe the container a hook is
+// being run for.
+func hookEnv(container *Container, hook string, inspect *docker.Container) []string {
+	var id, ip string
+	name := container.DockerName()
+	if inspect != nil {
+		id = inspect.ID
+		if len(inspect.Name) > 0 {
+			name = strings.TrimPrefix(inspect.Name, "/")
+		}
+		if inspect.State.Running && inspect.NetworkSettings != nil {
+			ip = inspect.NetworkSettings.IPAddress
+		}
+	}
+
+	return []string{
+		"DCONTROL_HOOK=" + hook,
+		"DCONTROL_PROJECT=" + container.Project,
+		"DCONTROL_CONTAINER=" + container.Name,
+		"DCONTROL_CONTAINER_NAME=" + name,
+		"DCONTROL_CONTAINER_ID=" + id,
+		"DCONTROL_CONTAINER_IP=" + ip,
+	}
+}
+
+// Runs all hooks of the given type for a container, stopping at the first
+// one that fails.
+func runHooks(client *docker.Client, container *Container, hook string, hooks []HookConfig) error {
+	return runHooksOn(client, container, container.DockerName(), hook, hooks)
+}
+
+// Like runHooks, but for the Docker container with the given ID or name,
+// which may not have the container's usual name while it's being replaced.
+func runHooksOn(client *docker.Client, container *Container, ref, hook string, hooks []HookConfig) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	// The container may not exist or may not be running yet, in which case
+	// the hooks just don't get an ID or IP.
+	inspect, err := client.InspectContainer(ref)
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); !ok {
+			return fmt.Errorf("Error inspecting container: %s", err)
+		}
+		inspect = nil
+	}
+
+	env := hookEnv(container, hook, inspect)
+	for i, h := range hooks {
+		log.Infof("%s: Running %s hook %d/%d", container.Name, hook, i+1, len(hooks))
+
+		if len(h.Image) > 0 {
+			err = runContainerHook(client, container, h, env, inspect)
+		} else {
+			err = runHostHook(h, env)
+		}
+		if err != nil {
+			return fmt.Errorf("Hook %s %d failed: %s", hook, i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func runHostHook(hook HookConfig, env []string) error {
+	cmd := exec.Command("/bin/sh", "-c", hook.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Runs a hook in a new container, which is linked to the target container if
+// that is running.  The hook container is removed afterwards.
+func runContainerHook(client *docker.Client, container *Container, hook HookConfig, env []string, inspect *docker.Container) error {
+	opts := docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: hook.Image,
+			Env:   env,
+		},
+	}
+	if len(hook.Command) > 0 {
+		opts.Config.Cmd = []string{"/bin/sh", "-c", hook.Command}
+	}
+
+	created, err := client.CreateContainer(opts)
+	if err != nil {
+		return fmt.Errorf("Error creating hook container: %s", err)
+	}
+	defer func() {
+		err := client.RemoveContainer(docker.RemoveContainerOptions{ID: created.ID, Force: true})
+		if err != nil {
+			log.Warnf("%s: Error removing hook container: %s", container.Name, err)
+		}
+	}()
+
+	hostConfig := &docker.HostConfig{}
+	if inspect != nil && inspect.State.Running {
+		hostConfig.Links = []string{inspect.ID + ":" + container.Name}
+	}
+
+	err = client.StartContainer(created.ID, hostConfig)
+	if err != nil {
+		return fmt.Errorf("Error starting hook container: %s", err)
+	}
+
+	code, err := client.WaitContainer(created.ID)
+	if err != nil {
+		return fmt.Errorf("Error waiting for hook container: %s", err)
+	}
+
+	err = client.Logs(docker.LogsOptions{
+		Container:    created.ID,
+		OutputStream: os.Stdout,
+		ErrorStream:  os.Stderr,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil {
+		log.Warnf("%s: Error getting hook output: %s", container.Name, err)
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Hook container exited with code %d", code)
+	}
+	return nil
+}
+
+// Starts the Docker container with the given ID or name, running the start
+// hooks before and after.
+func startWithHooks(client *docker.Client, container *Container, ref string) error {
+	err := runHooksOn(client, container, ref, "pre_start", container.Hooks.PreStart)
+	if err != nil {
+		return err
+	}
+
+	err = client.StartContainer(ref, buildHostConfig(container))
+	if err != nil {
+		return fmt.Errorf("Error starting: %s", err)
+	}
+
+	return runHooksOn(client, container, ref, "post_start", container.Hooks.PostStart)
+}
+
+// Stops the Docker container with the given ID or name if it's running,
+// running the stop hooks before and after.  Returns whether the container
+// was stopped, since a post_stop hook can fail afterwards.
+func stopWithHooks(client *docker.Client, container *Container, ref string, timeout uint) (bool, error) {
+	inspect, err := client.InspectContainer(ref)
+	if err != nil {
+		return false, fmt.Errorf("Error inspecting container: %s", err)
+	}
+	if !inspect.State.Running {
+		return false, nil
+	}
+
+	err = runHooksOn(client, container, ref, "pre_stop", container.Hooks.PreStop)
+	if err != nil {
+		return false, err
+	}
+
+	err = client.StopContainer(ref, timeout)
+	if _, ok := err.(*docker.ContainerNotRunning); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error stopping: %s", err)
+	}
+
+	return true, runHooksOn(client, container, ref, "post_stop", container.Hooks.PostStop)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHooks(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "dcontrol-hooks")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	id := s.runContainer(t)
+	container := &Container{Name: id, Image: "busybox"}
+	inspect, err := s.client.InspectContainer(id)
+	if err != nil {
+		t.Fatalf("Error inspecting container: %s", err)
+	}
+
+	out := filepath.Join(dir, "out")
+	hooks := []HookConfig{
+		{Command: "echo $DCONTROL_HOOK $DCONTROL_CONTAINER_IP >> " + out},
+		{Command: "echo second >> " + out},
+	}
+
+	err = runHooks(s.client, container, "post_start", hooks)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Split(strings.TrimSpace(string(data)), "\n"), []string{
+		"post_start " + inspect.NetworkSettings.IPAddress,
+		"second",
+	})
+
+	// A failing hook stops the rest from running.
+	hooks = []HookConfig{
+		{Command: "exit 3"},
+		{Command: "echo third >> " + out},
+	}
+	err = runHooks(s.client, container, "pre_stop", hooks)
+	assert.EqualError(t, err, "Hook pre_stop 1 failed: exit status 3")
+
+	data, err = ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "third")
+}
+
+func TestHookEnv(t *testing.T) {
+	t.Parallel()
+
+	container := &Container{Name: "db", Project: "myapp"}
+	assert.Equal(t, hookEnv(container, "pre_start", nil), []string{
+		"DCONTROL_HOOK=pre_start",
+		"DCONTROL_PROJECT=myapp",
+		"DCONTROL_CONTAINER=db",
+		"DCONTROL_CONTAINER_NAME=myapp_db",
+		"DCONTROL_CONTAINER_ID=",
+		"DCONTROL_CONTAINER_IP=",
+	})
+}
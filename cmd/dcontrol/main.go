@@ -4,20 +4,45 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/andrew-d/docker-tools/dockerconn"
+	"github.com/andrew-d/docker-tools/exitcode"
 	"github.com/andrew-d/docker-tools/log"
 	flag "github.com/ogier/pflag"
 	"gopkg.in/yaml.v1"
 )
 
 var (
-	flagConfig string
+	flagDocker     dockerconn.Options
+	flagConfig     string
+	flagProject    string
+	flagBackoff    time.Duration
+	flagMaxBackoff time.Duration
+
+	flagMaxUnavailable int
+	flagReadyDelay     time.Duration
+	flagReadyTimeout   time.Duration
 )
 
 func init() {
+	flagDocker.AddFlags(flag.CommandLine)
 	flag.StringVarP(&flagConfig, "config", "c", "./config.yaml",
 		"The config file to use")
+	flag.StringVarP(&flagProject, "project", "p", "",
+		"The project name to prefix containers with (default: from config, or the config's directory)")
+	flag.DurationVar(&flagBackoff, "backoff", time.Second,
+		"Initial delay before restarting a container that died (watch only)")
+	flag.DurationVar(&flagMaxBackoff, "max-backoff", time.Minute,
+		"Maximum delay before restarting a container that died (watch only)")
+	flag.IntVar(&flagMaxUnavailable, "max-unavailable", 1,
+		"Maximum number of containers to replace at once (rollout only)")
+	flag.DurationVar(&flagReadyDelay, "ready-delay", 5*time.Second,
+		"How long a replacement must stay running to be ready (rollout only)")
+	flag.DurationVar(&flagReadyTimeout, "ready-timeout", time.Minute,
+		"How long to wait for a replacement's ready port (rollout only)")
 }
 
 func usage() {
@@ -29,42 +54,127 @@ Commands:
     start <cluster>         Start all containers in a given cluster.
     stop <cluster>          Stop all containers in a given cluster.
     restart <cluster>       Restart all containers in a given cluster.
+    rollout <cluster>       Replace all containers in a given cluster whose
+                            image has changed, without stopping the cluster.
     status <cluster>        Show the status of all the containers in a given
                             cluster.
+    scale <container> <N>   Create and start, or stop and remove, instances of
+                            a scaled container so that there are N of them.
+    watch <cluster>         Watch all containers in a given cluster, and
+                            restart them (and their dependents) if they die.
+
+Exit codes:
+    0   Success.
+    1   The command failed, without changing any containers.
+    2   Invalid arguments.
+    3   Invalid config file.
+    4   Couldn't connect to Docker.
+    5   Partial success: the command failed after changing some containers.
 
 Options:
 `))
 	flag.PrintDefaults()
-	os.Exit(1)
 }
 
 func main() {
+	err := runMain()
+	if err == errUsage {
+		usage()
+	} else if err != nil {
+		log.Errorf("%s", err)
+	}
+	os.Exit(exitcode.Of(err))
+}
+
+// The commands, and the number of arguments that each takes.
+var commandArgs = map[string]int{
+	"create":  1,
+	"start":   1,
+	"stop":    1,
+	"rollout": 1,
+	"status":  1,
+	"scale":   2,
+	"watch":   1,
+}
+
+// Runs the command given on the command line.
+func runMain() error {
 	flag.Parse()
 
 	if flag.NArg() < 2 {
-		usage()
+		return errUsage
+	}
+
+	// Check the command before reading the config.
+	cmd := strings.ToLower(flag.Arg(0))
+	nargs, ok := commandArgs[cmd]
+	if !ok {
+		return exitcode.Errorf(exitUsage, "Unknown command: %s", cmd)
+	}
+	if flag.NArg() < nargs+1 {
+		return errUsage
 	}
 
 	log.Infof("Started")
 
-	f, err := os.Open(flagConfig)
+	config, err := readConfig(flagConfig)
 	if err != nil {
-		log.Errorf("Error opening config file: %s", err)
-		return
+		return exitcode.With(exitConfig, err)
+	}
+
+	// Figure out what we're doing with our config.
+	switch cmd {
+	case "create":
+		err = cmdCreate(config)
+
+	case "start":
+		err = cmdStart(config)
+
+	case "rollout":
+		err = cmdRollout(config)
+
+	case "scale":
+		var count int
+		count, err = strconv.Atoi(flag.Arg(2))
+		if err != nil {
+			return exitcode.Errorf(exitUsage, "Invalid scale: %s", flag.Arg(2))
+		}
+		err = cmdScale(config, flag.Arg(1), count)
+
+	case "stop":
+		err = cmdStop(config)
+
+	case "status":
+		err = cmdStatus(config)
+
+	case "watch":
+		err = cmdWatch(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Completed successfully")
+	return nil
+}
+
+// Reads and parses the config file.
+func readConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening config file: %s", err)
 	}
 	defer f.Close()
 
 	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		log.Errorf("Error reading config file: %s", err)
-		return
+		return nil, fmt.Errorf("Error reading config file: %s", err)
 	}
 
 	var rawConfig map[string]interface{}
 	err = yaml.Unmarshal(data, &rawConfig)
 	if err != nil {
-		log.Errorf("Error parsing config file: %s", err)
-		return
+		return nil, fmt.Errorf("Error parsing config file: %s", err)
 	}
 
 	log.Debugf("Config: %+v", rawConfig)
@@ -76,10 +186,16 @@ func main() {
 	var ok bool
 	var subConfig map[interface{}]interface{}
 
+	// Find the project name.
+	config.Project, err = parseProject(flagProject, rawConfig["project"], path)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing project name: %s", err)
+	}
+	log.Infof("Using project: %s", config.Project)
+
 	// Parse containers.
 	if subConfig, ok = rawConfig["containers"].(map[interface{}]interface{}); !ok {
-		log.Errorf("Missing or invalid 'containers' key in config")
-		return
+		return nil, fmt.Errorf("Missing or invalid 'containers' key in config")
 	}
 
 	for k, v := range subConfig {
@@ -87,34 +203,25 @@ func main() {
 
 		c, err := parseContainer(name, v)
 		if err != nil {
-			log.Errorf("Error parsing container %s: %s", name, err)
-			return
+			return nil, fmt.Errorf("Error parsing container %s: %s", name, err)
 		}
+		c.Project = config.Project
 
 		config.Containers = append(config.Containers, c)
 	}
 
+	// Replace scaled containers with their instances.
+	config.Containers, err = expandScaledContainers(config.Containers)
+	if err != nil {
+		return nil, fmt.Errorf("Error scaling containers: %s", err)
+	}
+
 	// Find the topological sorting of our containers.
 	config.ContainerSort, err = TopoSortContainers(config.Containers)
 	if err != nil {
 		// TODO: good message?
-		log.Errorf("Error topologically sorting: %s", err)
-		return
-	}
-
-	// Figure out what we're doing with our config.
-	cmd := strings.ToLower(flag.Arg(0))
-	switch cmd {
-	case "create":
-		cmdCreate(config)
-
-	case "start":
-		cmdStart(config)
-
-	default:
-		log.Errorf("Unknown command: %s", cmd)
-		return
+		return nil, fmt.Errorf("Error topologically sorting: %s", err)
 	}
 
-	log.Infof("Completed successfully")
+	return config, nil
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// When this is set, the test binary runs dcontrol itself, so that tests can
+// check the code it exits with.
+const runMainEnv = "DCONTROL_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// Runs dcontrol against the given Docker host, and returns its exit code.
+func runDcontrol(t *testing.T, host string, args ...string) int {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "DOCKER_HOST="+host)
+	out, err := cmd.CombinedOutput()
+	t.Logf("dcontrol %v:\n%s", args, out)
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("Error running dcontrol: %s", err)
+	}
+	return 0
+}
+
+func writeConfig(t *testing.T, dir, name, config string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+	return "--config=" + path
+}
+
+func TestExitCodes(t *testing.T) {
+	t.Parallel()
+
+	server := newTestServer(t)
+	defer server.Close()
+	host := server.URL()
+
+	dir, err := ioutil.TempDir("", "dcontrol-test")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake server has the busybox image, but not the other one, so only
+	// the first container can be created.
+	good := writeConfig(t, dir, "good.yaml", "containers:\n"+
+		"  db:\n"+
+		"    image: busybox\n")
+	partial := writeConfig(t, dir, "partial.yaml", "containers:\n"+
+		"  db:\n"+
+		"    image: busybox\n"+
+		"  app:\n"+
+		"    image: myapp\n"+
+		"    dependencies:\n"+
+		"      - db\n")
+	invalid := writeConfig(t, dir, "invalid.yaml", "project: test\n")
+	missing := "--config=" + filepath.Join(dir, "missing.yaml")
+
+	for _, c := range []struct {
+		host string
+		args []string
+		code int
+	}{
+		{host, []string{good, "status", "test"}, exitOK},
+		{host, []string{good, "create", "test"}, exitOK},
+
+		{host, []string{good, "status"}, exitUsage},
+		{host, []string{good, "launch", "test"}, exitUsage},
+		{host, []string{good, "scale", "db"}, exitUsage},
+		{host, []string{good, "scale", "db", "2"}, exitUsage},
+
+		{host, []string{missing, "status", "test"}, exitConfig},
+		{host, []string{invalid, "status", "test"}, exitConfig},
+
+		{"tcp://127.0.0.1:1", []string{good, "--ping-retries=0", "status", "test"}, exitConnection},
+
+		{host, []string{good, "start", "test"}, exitFailure},
+
+		{host, []string{partial, "create", "test"}, exitPartial},
+	} {
+		assert.Equal(t, runDcontrol(t, c.host, c.args...), c.code, "dcontrol %v", c.args)
+	}
+}
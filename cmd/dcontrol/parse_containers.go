@@ -59,6 +59,15 @@ func parseContainerMap(name string, config map[interface{}]interface{}) (*Contai
 		case "privileged":
 			err = parseContainerMapPrivileged(ret, val)
 
+		case "scale":
+			err = parseContainerMapScale(ret, val)
+
+		case "ready-port":
+			err = parseContainerMapReadyPort(ret, val)
+
+		case "hooks":
+			err = parseContainerMapHooks(ret, val)
+
 		// TODO: extra runtime arguments
 
 		default:
@@ -70,6 +79,17 @@ func parseContainerMap(name string, config map[interface{}]interface{}) (*Contai
 		}
 	}
 
+	// Scaled containers can't all bind the same host port, so we require
+	// that Docker picks one for each instance.
+	if ret.Scale > 0 {
+		for _, port := range ret.Ports {
+			if port.HostPort != 0 {
+				return nil, fmt.Errorf("Container %s is scaled, but binds host port %d (scaled containers must use a host port of 0)",
+					name, port.HostPort)
+			}
+		}
+	}
+
 	return ret, nil
 }
 
@@ -108,6 +128,22 @@ func parseContainerMapDependencies(ret *Container, val interface{}) error {
 		case 2:
 			dconf.Name = parts[0]
 			dconf.Alias = parts[1]
+		case 3:
+			// The only valid option is 'all', which links to all instances
+			// of a scaled container.
+			if parts[2] != "all" {
+				return fmt.Errorf("Unknown format for dependency entry %d", i)
+			}
+
+			dconf.Name = parts[0]
+			dconf.Alias = parts[1]
+			dconf.All = true
+
+			// Note: the alias may be empty, in which case it is the same
+			// as the name.
+			if len(dconf.Alias) == 0 {
+				dconf.Alias = dconf.Name
+			}
 		default:
 			return fmt.Errorf("Unknown format for dependency entry %d", i)
 		}
@@ -302,3 +338,120 @@ func parseContainerMapPrivileged(ret *Container, val interface{}) error {
 	}
 	return nil
 }
+
+func parseContainerMapScale(ret *Container, val interface{}) error {
+	var ok bool
+
+	ret.Scale, ok = val.(int)
+	if !ok {
+		return fmt.Errorf("Unknown value type: %T", val)
+	}
+	if ret.Scale < 1 {
+		return fmt.Errorf("Scale must be at least 1: %d", ret.Scale)
+	}
+	return nil
+}
+
+func parseContainerMapReadyPort(ret *Container, val interface{}) error {
+	port, ok := val.(int)
+	if !ok {
+		return fmt.Errorf("Unknown value type: %T", val)
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("Port out of range: %d", port)
+	}
+
+	ret.ReadyPort = uint16(port)
+	return nil
+}
+
+func parseContainerMapHooks(ret *Container, val interface{}) error {
+	var ok bool
+	var hooks map[interface{}]interface{}
+	var key string
+
+	if hooks, ok = val.(map[interface{}]interface{}); !ok {
+		return fmt.Errorf("Unknown value type: %T", val)
+	}
+
+	for k, v := range hooks {
+		if key, ok = k.(string); !ok {
+			return fmt.Errorf("Unknown hook: %+v", k)
+		}
+
+		parsed, err := parseHookList(v)
+		if err != nil {
+			return fmt.Errorf("Error parsing hook '%s': %s", key, err)
+		}
+
+		switch key {
+		case "pre_start":
+			ret.Hooks.PreStart = parsed
+		case "post_start":
+			ret.Hooks.PostStart = parsed
+		case "pre_stop":
+			ret.Hooks.PreStop = parsed
+		case "post_stop":
+			ret.Hooks.PostStop = parsed
+		default:
+			return fmt.Errorf("Unknown hook: %s", key)
+		}
+	}
+
+	return nil
+}
+
+// A hook is either a single entry, or a list of entries.
+func parseHookList(val interface{}) ([]HookConfig, error) {
+	entries, ok := val.([]interface{})
+	if !ok {
+		entries = []interface{}{val}
+	}
+
+	ret := []HookConfig{}
+	for i, e := range entries {
+		hook, err := parseHook(e)
+		if err != nil {
+			return nil, fmt.Errorf("Entry %d: %s", i, err)
+		}
+		ret = append(ret, hook)
+	}
+
+	return ret, nil
+}
+
+// A hook entry is either a string (a command to run on the host), or a map
+// with 'command' and/or 'image' keys.
+func parseHook(val interface{}) (HookConfig, error) {
+	var ret HookConfig
+
+	switch v := val.(type) {
+	case string:
+		ret.Command = v
+
+	case map[interface{}]interface{}:
+		for k, kv := range v {
+			str, ok := kv.(string)
+			if !ok {
+				return ret, fmt.Errorf("Unknown value type for key '%v': %T", k, kv)
+			}
+
+			switch k {
+			case "command":
+				ret.Command = str
+			case "image":
+				ret.Image = str
+			default:
+				return ret, fmt.Errorf("Unknown key: %v", k)
+			}
+		}
+
+	default:
+		return ret, fmt.Errorf("Unknown value type: %T", v)
+	}
+
+	if len(ret.Command) == 0 && len(ret.Image) == 0 {
+		return ret, fmt.Errorf("Hook must have a command or an image")
+	}
+	return ret, nil
+}
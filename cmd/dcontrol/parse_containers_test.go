@@ -29,13 +29,17 @@ func TestParseContainerDependencies(t *testing.T) {
 	input := []interface{}{
 		"foo",
 		"bar:baz",
+		"abc:def:all",
+		"ghi::all",
 	}
 
 	err = parseContainerMapDependencies(&q, input)
 	assert.NoError(t, err)
 	assert.Equal(t, q.Dependencies, []DepConfig{
-		{"foo", "foo"},
-		{"bar", "baz"},
+		{"foo", "foo", false},
+		{"bar", "baz", false},
+		{"abc", "def", true},
+		{"ghi", "ghi", true},
 	})
 
 	input = []interface{}{
@@ -276,3 +280,112 @@ func TestParseContainer(t *testing.T) {
 	c, err = parseContainer("bad", 1234)
 	assert.EqualError(t, err, "Unknown type for 'containers' key: int")
 }
+
+func TestParseContainerScale(t *testing.T) {
+	t.Parallel()
+
+	var q Container
+	var err error
+
+	err = parseContainerMapScale(&q, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Scale, 3)
+
+	err = parseContainerMapScale(&q, 0)
+	assert.EqualError(t, err, "Scale must be at least 1: 0")
+
+	err = parseContainerMapScale(&q, "foo")
+	assert.EqualError(t, err, "Unknown value type: string")
+}
+
+func TestParseContainerScaledPorts(t *testing.T) {
+	t.Parallel()
+
+	_, err := parseContainerMap("worker", map[interface{}]interface{}{
+		"scale": 2,
+		"ports": []interface{}{"0:80"},
+	})
+	assert.NoError(t, err)
+
+	_, err = parseContainerMap("worker", map[interface{}]interface{}{
+		"scale": 2,
+		"ports": []interface{}{80},
+	})
+	assert.EqualError(t, err, "Container worker is scaled, but binds host port 80 (scaled containers must use a host port of 0)")
+}
+
+func TestParseContainerReadyPort(t *testing.T) {
+	t.Parallel()
+
+	var q Container
+	var err error
+
+	err = parseContainerMapReadyPort(&q, 8080)
+	assert.NoError(t, err)
+	assert.Equal(t, q.ReadyPort, uint16(8080))
+
+	err = parseContainerMapReadyPort(&q, 99999)
+	assert.EqualError(t, err, "Port out of range: 99999")
+
+	err = parseContainerMapReadyPort(&q, "foo")
+	assert.EqualError(t, err, "Unknown value type: string")
+}
+
+func TestParseContainerHooks(t *testing.T) {
+	t.Parallel()
+
+	var q Container
+	var err error
+
+	input := map[interface{}]interface{}{
+		"pre_start": "echo hello",
+		"post_start": []interface{}{
+			"echo one",
+			map[interface{}]interface{}{
+				"image":   "myapp-migrate",
+				"command": "rake db:migrate",
+			},
+		},
+		"pre_stop": map[interface{}]interface{}{
+			"image": "flush-cache",
+		},
+	}
+
+	err = parseContainerMapHooks(&q, input)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Hooks, HooksConfig{
+		PreStart: []HookConfig{
+			{"echo hello", ""},
+		},
+		PostStart: []HookConfig{
+			{"echo one", ""},
+			{"rake db:migrate", "myapp-migrate"},
+		},
+		PreStop: []HookConfig{
+			{"", "flush-cache"},
+		},
+	})
+
+	err = parseContainerMapHooks(&q, map[interface{}]interface{}{
+		"post_frobnicate": "echo hello",
+	})
+	assert.EqualError(t, err, "Unknown hook: post_frobnicate")
+
+	err = parseContainerMapHooks(&q, map[interface{}]interface{}{
+		"pre_start": []interface{}{"echo hello", 1234},
+	})
+	assert.EqualError(t, err, "Error parsing hook 'pre_start': Entry 1: Unknown value type: int")
+
+	err = parseContainerMapHooks(&q, map[interface{}]interface{}{
+		"pre_start": map[interface{}]interface{}{"foo": "bar"},
+	})
+	assert.EqualError(t, err, "Error parsing hook 'pre_start': Entry 0: Unknown key: foo")
+
+	err = parseContainerMapHooks(&q, map[interface{}]interface{}{
+		"pre_start": map[interface{}]interface{}{},
+	})
+	assert.EqualError(t, err, "Error parsing hook 'pre_start': Entry 0: Hook must have a command or an image")
+
+	err = parseContainerMapHooks(&q, 1234)
+	assert.EqualError(t, err, "Unknown value type: int")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Determine the project name.  In order of priority, this is taken from the
+// command-line flag, the 'project' key in the config, or the name of the
+// directory containing the config file.
+func parseProject(flagValue string, config interface{}, configPath string) (string, error) {
+	if len(flagValue) > 0 {
+		return normalizeProjectName(flagValue)
+	}
+
+	if config != nil {
+		project, ok := config.(string)
+		if !ok {
+			return "", fmt.Errorf("Unknown value type for 'project' key: %T", config)
+		}
+		return normalizeProjectName(project)
+	}
+
+	abs, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", err
+	}
+	return normalizeProjectName(filepath.Base(filepath.Dir(abs)))
+}
+
+// Project names are lowercased and stripped of anything that's not a letter
+// or digit, since they form part of the container names in Docker.
+func normalizeProjectName(name string) (string, error) {
+	ret := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return -1
+	}, name)
+
+	if len(ret) == 0 {
+		return "", fmt.Errorf("Invalid project name: %q", name)
+	}
+	return ret, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProject(t *testing.T) {
+	t.Parallel()
+
+	var project string
+	var err error
+
+	project, err = parseProject("flag", "config", "/foo/dir/config.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, project, "flag")
+
+	project, err = parseProject("", "config", "/foo/dir/config.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, project, "config")
+
+	project, err = parseProject("", nil, "/foo/dir/config.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, project, "dir")
+
+	_, err = parseProject("", 1234, "/foo/dir/config.yaml")
+	assert.EqualError(t, err, "Unknown value type for 'project' key: int")
+}
+
+func TestNormalizeProjectName(t *testing.T) {
+	t.Parallel()
+
+	var project string
+	var err error
+
+	project, err = normalizeProjectName("My-App_2")
+	assert.NoError(t, err)
+	assert.Equal(t, project, "myapp2")
+
+	_, err = normalizeProjectName("---")
+	assert.EqualError(t, err, `Invalid project name: "---"`)
+}
+
+func TestDockerName(t *testing.T) {
+	t.Parallel()
+
+	c := &Container{Name: "db", Project: "myapp"}
+	assert.Equal(t, c.DockerName(), "myapp_db")
+
+	c = &Container{Name: "db"}
+	assert.Equal(t, c.DockerName(), "db")
+}
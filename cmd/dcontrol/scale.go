@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Returns the given instance of a scaled container.
+func instanceOf(container *Container, instance int) *Container {
+	ret := *container
+	ret.Name = fmt.Sprintf("%s_%d", container.Base, instance)
+	ret.Instance = instance
+	return &ret
+}
+
+// Replaces each scaled container with its instances, and rewrites any
+// dependencies on scaled containers to point at the instances.  By default, a
+// dependency links to the first instance under the original alias; if the
+// dependency asks for all instances, then it links to each instance with an
+// indexed alias (e.g. 'worker_1', 'worker_2', ...).
+func expandScaledContainers(containers []*Container) ([]*Container, error) {
+	scales := make(map[string]int)
+	for _, c := range containers {
+		if c.Scale > 0 {
+			scales[c.Name] = c.Scale
+		}
+	}
+
+	ret := []*Container{}
+	for _, c := range containers {
+		deps := []DepConfig{}
+		for _, dep := range c.Dependencies {
+			scale, ok := scales[dep.Name]
+			if !ok {
+				if dep.All {
+					return nil, fmt.Errorf("Container %s links to all instances of %s, but it is not scaled",
+						c.Name, dep.Name)
+				}
+
+				deps = append(deps, dep)
+				continue
+			}
+
+			if !dep.All {
+				scale = 1
+			}
+			for i := 1; i <= scale; i++ {
+				ndep := dep
+				ndep.Name = fmt.Sprintf("%s_%d", dep.Name, i)
+				if dep.All {
+					ndep.Alias = fmt.Sprintf("%s_%d", dep.Alias, i)
+				}
+				deps = append(deps, ndep)
+			}
+		}
+		c.Dependencies = deps
+
+		// Mounting volumes from a scaled container uses the first instance.
+		for i, mfrom := range c.MountFrom {
+			if _, ok := scales[mfrom]; ok {
+				c.MountFrom[i] = mfrom + "_1"
+			}
+		}
+
+		if c.Scale == 0 {
+			ret = append(ret, c)
+			continue
+		}
+
+		c.Base = c.Name
+		for i := 1; i <= c.Scale; i++ {
+			ret = append(ret, instanceOf(c, i))
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandScaledContainers(t *testing.T) {
+	t.Parallel()
+
+	containers, err := expandScaledContainers([]*Container{
+		{Name: "worker", Scale: 3},
+		{Name: "app", Dependencies: []DepConfig{{"worker", "w", false}}},
+		{Name: "lb", Dependencies: []DepConfig{{"worker", "w", true}}},
+		{Name: "backup", MountFrom: []string{"worker", "other"}},
+	})
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, names, []string{
+		"worker_1", "worker_2", "worker_3", "app", "lb", "backup",
+	})
+
+	for i, c := range containers[:3] {
+		assert.Equal(t, c.Base, "worker")
+		assert.Equal(t, c.Instance, i+1)
+	}
+
+	assert.Equal(t, containers[3].Dependencies, []DepConfig{
+		{"worker_1", "w", false},
+	})
+	assert.Equal(t, containers[4].Dependencies, []DepConfig{
+		{"worker_1", "w_1", true},
+		{"worker_2", "w_2", true},
+		{"worker_3", "w_3", true},
+	})
+	assert.Equal(t, containers[5].MountFrom, []string{"worker_1", "other"})
+
+	_, err = expandScaledContainers([]*Container{
+		{Name: "worker"},
+		{Name: "lb", Dependencies: []DepConfig{{"worker", "w", true}}},
+	})
+	assert.EqualError(t, err, "Container lb links to all instances of worker, but it is not scaled")
+}
+
+func TestParseInstanceName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name     string
+		Instance int
+		Ok       bool
+	}{
+		{"/myapp_worker_1", 1, true},
+		{"myapp_worker_12", 12, true},
+		{"/myapp_worker_0", 0, false},
+		{"/myapp_worker_big_1", 0, false},
+		{"/myapp_web_1", 0, false},
+	}
+
+	for _, test := range tests {
+		instance, ok := parseInstanceName(test.Name, "myapp_worker_")
+		assert.Equal(t, instance, test.Instance)
+		assert.Equal(t, ok, test.Ok)
+	}
+}
@@ -34,13 +34,13 @@ func TopoSortContainers(containers []*Container) ([]int, error) {
 	for ci, c := range containers {
 		for _, dep := range c.Dependencies {
 			if dep.Name == c.Name {
-				return nil, fmt.Errorf("Container '%s' depends on itself", dep)
+				return nil, fmt.Errorf("Container '%s' depends on itself", dep.Name)
 			}
 
 			// Ensure the dependency exists.
 			if _, ok := indexes[dep.Name]; !ok {
 				return nil, fmt.Errorf("Dependency '%s' for container '%s' does not exist",
-					dep, c.Name)
+					dep.Name, c.Name)
 			}
 
 			edges[indexes[dep.Name]] = append(edges[indexes[dep.Name]], ci)
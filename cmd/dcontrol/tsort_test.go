@@ -77,7 +77,7 @@ func TestRandomGraphs(t *testing.T) {
 			// Validate dependencies
 			for i, dep := range node.Dependencies {
 				if !done[dep.Name] {
-					t.Fatalf("Node %d: dependency %d (%s) not done", idx, i, dep)
+					t.Fatalf("Node %d: dependency %d (%s) not done", idx, i, dep.Name)
 				}
 			}
 
@@ -1,6 +1,9 @@
 package main
 
 type Config struct {
+	// The project name, used to namespace containers.
+	Project string
+
 	// Parsed containers and topological sort.
 	Containers    []*Container
 	ContainerSort []int
@@ -8,19 +11,64 @@ type Config struct {
 
 type Container struct {
 	Name       string
+	Project    string
 	Image      string
 	Privileged bool
 
+	// For scaled containers, the name of the container in the config file,
+	// the number of instances, and which instance (starting at 1) this is.
+	Base     string
+	Scale    int
+	Instance int
+
 	Dependencies []DepConfig
 	Env          []EnvConfig
 	Ports        []PortConfig
 	Mount        []MountConfig
 	MountFrom    []string
+
+	// If set, a container is only considered ready once this port accepts
+	// connections.
+	ReadyPort uint16
+
+	Hooks HooksConfig
+}
+
+// DockerName returns the name of this container in Docker.
+func (c *Container) DockerName() string {
+	return dockerName(c.Project, c.Name)
+}
+
+// Returns the name of a container in Docker, given the project it belongs to
+// and its name in the config file.
+func dockerName(project, name string) string {
+	if len(project) == 0 {
+		return name
+	}
+	return project + "_" + name
 }
 
 type DepConfig struct {
 	Name  string
 	Alias string
+
+	// Link to all instances of a scaled container, rather than the first.
+	All bool
+}
+
+// HookConfig is a command that's run around a container's lifecycle.  If an
+// image is given, the command is run in a new container from that image;
+// otherwise, it's run on the host.
+type HookConfig struct {
+	Command string
+	Image   string
+}
+
+type HooksConfig struct {
+	PreStart  []HookConfig
+	PostStart []HookConfig
+	PreStop   []HookConfig
+	PostStop  []HookConfig
 }
 
 type PortConfig struct {
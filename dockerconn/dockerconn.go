@@ -0,0 +1,285 @@
+// Package dockerconn connects to Docker in the same way for every tool: the
+// endpoint comes from a flag, then $DOCKER_HOST, then the default socket, and
+// TLS is set up from flags or $DOCKER_TLS_VERIFY and $DOCKER_CERT_PATH, as
+// with the Docker client itself.
+package dockerconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+	flag "github.com/ogier/pflag"
+)
+
+// DefaultEndpoint is used when no endpoint is given, and $DOCKER_HOST isn't
+// set.
+const DefaultEndpoint = "unix:///var/run/docker.sock"
+
+// The delay before the first retry of a failed ping.  It doubles with each
+// retry after that.
+const pingBackoff = 500 * time.Millisecond
+
+// Options says how to connect to Docker.  Anything that isn't set is taken
+// from the environment, or a default.
+type Options struct {
+	Endpoint string
+
+	// Whether to use TLS, and whether to verify the server's certificate.
+	// Verifying implies using TLS.
+	TLS       bool
+	TLSVerify bool
+
+	// The CA certificate to verify the server with, and the client's
+	// certificate and key.  By default, these are ca.pem, cert.pem and
+	// key.pem in $DOCKER_CERT_PATH, or ~/.docker, if they exist.
+	CACert string
+	Cert   string
+	Key    string
+
+	// How long to wait to connect, and then for a response to each request.
+	// A request timeout of zero means no limit, since builds and exports can
+	// take a long time.
+	ConnectTimeout time.Duration
+	RequestTimeout time.Duration
+
+	// How many times to retry a failed ping when connecting.
+	PingRetries int
+}
+
+// AddFlags adds flags for the options to the given flag set.
+func (o *Options) AddFlags(flags *flag.FlagSet) {
+	flags.StringVarP(&o.Endpoint, "endpoint", "e", "",
+		"How to connect to the Docker service (default: $DOCKER_HOST, or "+DefaultEndpoint+")")
+	flags.BoolVar(&o.TLS, "tls", false,
+		"Use TLS to connect to Docker, without verifying its certificate")
+	flags.BoolVar(&o.TLSVerify, "tlsverify", false,
+		"Use TLS to connect to Docker, and verify its certificate (default: true if $DOCKER_TLS_VERIFY is set)")
+	flags.StringVar(&o.CACert, "tlscacert", "",
+		"The CA certificate to verify Docker's certificate with (default: ca.pem in $DOCKER_CERT_PATH or ~/.docker)")
+	flags.StringVar(&o.Cert, "tlscert", "",
+		"The client certificate to connect to Docker with (default: cert.pem in $DOCKER_CERT_PATH or ~/.docker)")
+	flags.StringVar(&o.Key, "tlskey", "",
+		"The client certificate's key (default: key.pem in $DOCKER_CERT_PATH or ~/.docker)")
+	flags.DurationVar(&o.ConnectTimeout, "connect-timeout", 10*time.Second,
+		"How long to wait to connect to Docker")
+	flags.DurationVar(&o.RequestTimeout, "timeout", 0,
+		"How long to wait for Docker to respond to each request (default: no limit)")
+	flags.IntVar(&o.PingRetries, "ping-retries", 3,
+		"How many times to retry connecting to Docker, with increasing delays, before giving up")
+}
+
+// Fills in everything that isn't set from the environment, or the defaults.
+// Certificates that are only found by default are used if they exist.
+func (o Options) resolve(getenv func(string) string) Options {
+	if len(o.Endpoint) == 0 {
+		o.Endpoint = getenv("DOCKER_HOST")
+	}
+	if len(o.Endpoint) == 0 {
+		o.Endpoint = DefaultEndpoint
+	}
+
+	if len(getenv("DOCKER_TLS_VERIFY")) > 0 {
+		o.TLSVerify = true
+	}
+	if o.TLSVerify {
+		o.TLS = true
+	}
+	if !o.TLS {
+		return o
+	}
+
+	certPath := getenv("DOCKER_CERT_PATH")
+	if len(certPath) == 0 {
+		certPath = filepath.Join(getenv("HOME"), ".docker")
+	}
+	for _, f := range []struct {
+		path *string
+		name string
+	}{
+		{&o.CACert, "ca.pem"},
+		{&o.Cert, "cert.pem"},
+		{&o.Key, "key.pem"},
+	} {
+		if len(*f.path) > 0 {
+			continue
+		}
+		if p := filepath.Join(certPath, f.name); fileExists(p) {
+			*f.path = p
+		}
+	}
+
+	return o
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Returns the TLS config for the given (resolved) options.
+func tlsConfig(o Options) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !o.TLSVerify}
+
+	if o.TLSVerify && len(o.CACert) > 0 {
+		data, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA certificate: %s", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", o.CACert)
+		}
+	}
+
+	if len(o.Cert) > 0 || len(o.Key) > 0 {
+		if len(o.Cert) == 0 || len(o.Key) == 0 {
+			return nil, fmt.Errorf("A client certificate and key must be given together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// A Conn is a connection to Docker.
+type Conn struct {
+	// The endpoint that's connected to.
+	Endpoint string
+
+	// The client to make API calls with.
+	Client *docker.Client
+
+	// A client for making requests that go-dockerclient can't, to the URLs
+	// returned by URL.
+	HTTPClient *http.Client
+
+	base        string
+	pingRetries int
+	sleep       func(time.Duration)
+}
+
+// New sets up a connection to Docker with the given options, without
+// connecting yet.
+func New(opts Options) (*Conn, error) {
+	opts = opts.resolve(os.Getenv)
+
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint %q: %s", opts.Endpoint, err)
+	}
+
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+	transport := &http.Transport{
+		Dial:                  dialer.Dial,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.RequestTimeout,
+	}
+
+	// Requests to a socket are made to a fake host name, which the transport
+	// dials the socket for.
+	var endpoint string
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return dialer.Dial("unix", socket)
+		}
+		u = &url.URL{Scheme: "http", Host: "docker"}
+
+		// go-dockerclient would dial the socket itself, without the
+		// timeouts, so it's given the fake host name too.
+		endpoint = u.String()
+
+	case "tcp", "http", "https":
+		// go-dockerclient treats "tcp" as plain HTTP, so it's given the
+		// scheme that we've chosen.
+		if u.Scheme == "https" {
+			opts.TLS = true
+		}
+		u.Scheme = "http"
+		if opts.TLS {
+			u.Scheme = "https"
+			transport.TLSClientConfig, err = tlsConfig(opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		endpoint = u.String()
+
+	default:
+		return nil, fmt.Errorf("Invalid endpoint %q: must be unix://, tcp://, http:// or https://", opts.Endpoint)
+	}
+
+	c := &Conn{
+		Endpoint:    opts.Endpoint,
+		HTTPClient:  &http.Client{Transport: transport},
+		base:        u.Scheme + "://" + u.Host,
+		pingRetries: opts.PingRetries,
+		sleep:       time.Sleep,
+	}
+
+	c.Client, err = docker.NewClient(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Docker client: %s", err)
+	}
+
+	// go-dockerclient's event listener doesn't use this, which is why Events
+	// exists.
+	c.Client.HTTPClient = c.HTTPClient
+
+	return c, nil
+}
+
+// Connect sets up a connection to Docker, and pings it to check that it can
+// be reached.
+func Connect(opts Options) (*Conn, error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Ping(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// URL returns the URL to make a request with the given path to, with
+// HTTPClient.
+func (c *Conn) URL(path string) string {
+	return c.base + path
+}
+
+// Ping checks that Docker can be reached, retrying with increasing delays if
+// it can't.
+func (c *Conn) Ping() error {
+	delay := pingBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.Client.Ping()
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.pingRetries {
+			return fmt.Errorf("Error pinging Docker at %s: %s", c.Endpoint, err)
+		}
+
+		log.Warnf("Error pinging Docker at %s (retrying in %s): %s", c.Endpoint, delay, err)
+		c.sleep(delay)
+		delay *= 2
+	}
+}
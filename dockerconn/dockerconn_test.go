@@ -0,0 +1,299 @@
+package dockerconn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dockerconn-test")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"ca.pem", "cert.pem"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	env := map[string]string{}
+	getenv := func(key string) string { return env[key] }
+
+	// The default.
+	o := Options{}.resolve(getenv)
+	assert.Equal(t, o.Endpoint, DefaultEndpoint)
+	assert.False(t, o.TLS)
+
+	// The environment, and then flags.
+	env["DOCKER_HOST"] = "tcp://env:2375"
+	o = Options{}.resolve(getenv)
+	assert.Equal(t, o.Endpoint, "tcp://env:2375")
+	o = Options{Endpoint: "tcp://flag:2375"}.resolve(getenv)
+	assert.Equal(t, o.Endpoint, "tcp://flag:2375")
+
+	// Certificates are found in $DOCKER_CERT_PATH if they exist, unless
+	// they're given.
+	env["DOCKER_TLS_VERIFY"] = "1"
+	env["DOCKER_CERT_PATH"] = dir
+	o = Options{Cert: "/my/cert.pem"}.resolve(getenv)
+	assert.True(t, o.TLS)
+	assert.True(t, o.TLSVerify)
+	assert.Equal(t, o.CACert, filepath.Join(dir, "ca.pem"))
+	assert.Equal(t, o.Cert, "/my/cert.pem")
+	assert.Equal(t, o.Key, "")
+
+	// And in ~/.docker otherwise.
+	delete(env, "DOCKER_CERT_PATH")
+	env["HOME"] = filepath.Dir(dir)
+	o = Options{}.resolve(getenv)
+	assert.Equal(t, o.CACert, "")
+}
+
+// Generates a certificate and key, signed by the given CA (or self-signed),
+// and writes them to <name>.pem and <name>-key.pem in the given directory.
+func writeCert(t *testing.T, dir, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Error loading certificate: %s", err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+func TestConnectTLS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dockerconn-test")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := writeCert(t, dir, "ca", nil)
+	serverCert := writeCert(t, dir, "server", &ca)
+	writeCert(t, dir, "client", &ca)
+	writeCert(t, dir, "other-ca", nil)
+
+	// A server that only accepts clients with a certificate from the CA.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			w.Write([]byte("OK"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    x509.NewCertPool(),
+	}
+	server.TLS.ClientCAs.AddCert(ca.Leaf)
+	server.StartTLS()
+	defer server.Close()
+
+	endpoint := "tcp://" + server.Listener.Addr().String()
+	opts := Options{
+		Endpoint:       endpoint,
+		TLSVerify:      true,
+		CACert:         filepath.Join(dir, "ca.pem"),
+		Cert:           filepath.Join(dir, "client.pem"),
+		Key:            filepath.Join(dir, "client-key.pem"),
+		ConnectTimeout: 5 * time.Second,
+	}
+
+	c, err := Connect(opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, c.Endpoint, endpoint)
+		assert.Equal(t, c.URL("/_ping"), "https://"+server.Listener.Addr().String()+"/_ping")
+
+		resp, err := c.HTTPClient.Get(c.URL("/_ping"))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// Without a client certificate, the server hangs up.
+	noCert := opts
+	noCert.Cert, noCert.Key = "", ""
+	_, err = Connect(noCert)
+	assert.Error(t, err)
+
+	// With the wrong CA, the server isn't trusted, unless it isn't verified.
+	wrongCA := opts
+	wrongCA.CACert = filepath.Join(dir, "other-ca.pem")
+	_, err = Connect(wrongCA)
+	assert.Error(t, err)
+
+	wrongCA.TLSVerify, wrongCA.TLS = false, true
+	_, err = Connect(wrongCA)
+	assert.NoError(t, err)
+
+	// A certificate without its key is an error.
+	noKey := opts
+	noKey.Key = ""
+	_, err = New(noKey)
+	assert.Error(t, err)
+}
+
+func TestPingRetries(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu    sync.Mutex
+		pings int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pings++
+		n := pings
+		mu.Unlock()
+
+		if n <= 2 {
+			http.Error(w, "starting up", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	c, err := New(Options{Endpoint: server.URL, PingRetries: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var delays []time.Duration
+	c.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	assert.NoError(t, c.Ping())
+	assert.Equal(t, delays, []time.Duration{pingBackoff, 2 * pingBackoff})
+
+	// Without enough retries, it fails.
+	mu.Lock()
+	pings = 0
+	mu.Unlock()
+	delays = nil
+	c.pingRetries = 1
+	assert.Error(t, c.Ping())
+	assert.Equal(t, delays, []time.Duration{pingBackoff})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	c, err := New(Options{Endpoint: server.URL, RequestTimeout: 50 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Error(t, c.Ping())
+}
+
+func TestRequestTimeoutUnix(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dockerconn-test")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+
+	done := make(chan struct{})
+	server := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/_ping" {
+				w.Write([]byte("OK"))
+				return
+			}
+			<-done
+		})},
+	}
+	server.Start()
+	defer server.Close()
+	defer close(done)
+
+	// Requests through go-dockerclient reach the socket, and time out.
+	c, err := New(Options{Endpoint: "unix://" + socket, RequestTimeout: 50 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, c.Ping())
+	_, err = c.Client.InspectContainer("stuck")
+	assert.Error(t, err)
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	t.Parallel()
+
+	for _, endpoint := range []string{"ftp://docker", "%zz"} {
+		_, err := New(Options{Endpoint: endpoint})
+		assert.Error(t, err, "endpoint %q", endpoint)
+	}
+}
@@ -0,0 +1,117 @@
+package dockerconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/andrew-d/docker-tools/log"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// The longest delay between attempts to reopen the event stream.
+const maxEventsBackoff = time.Minute
+
+// Events streams events from Docker to the given channel until the stop
+// channel is closed.  Unlike go-dockerclient's event listener, this uses
+// HTTPClient, so it works over TLS.  If the stream is interrupted, it's
+// reopened from the time of the last event seen, or from when it was first
+// opened, so that nothing is missed in between.
+func (c *Conn) Events(events chan<- *docker.APIEvents, stop <-chan struct{}) error {
+	opened := time.Now().Unix()
+	resp, err := c.openEvents(0)
+	if err != nil {
+		return err
+	}
+
+	go c.streamEvents(resp, events, stop, opened)
+	return nil
+}
+
+func (c *Conn) openEvents(since int64) (*http.Response, error) {
+	path := "/events"
+	if since != 0 {
+		path += fmt.Sprintf("?since=%d", since)
+	}
+
+	resp, err := c.HTTPClient.Get(c.URL(path))
+	if err != nil {
+		return nil, fmt.Errorf("Error streaming events: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Error streaming events: API error (%d): %s", resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+func (c *Conn) streamEvents(resp *http.Response, events chan<- *docker.APIEvents, stop <-chan struct{}, lastSeen int64) {
+	delay := pingBackoff
+
+	for {
+		lastSeen = readEvents(resp.Body, events, stop, lastSeen)
+
+		// Reopen the stream, unless we were stopped.
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			log.Warnf("Event stream from %s was interrupted, reopening in %s", c.Endpoint, delay)
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+			if delay *= 2; delay > maxEventsBackoff {
+				delay = maxEventsBackoff
+			}
+
+			var err error
+			resp, err = c.openEvents(lastSeen)
+			if err == nil {
+				delay = pingBackoff
+				break
+			}
+			log.Warnf("%s", err)
+		}
+	}
+}
+
+// Sends the events from the given stream until it ends, or the stop channel
+// is closed, and then closes it.  Returns the time of the last event seen.
+func readEvents(body io.ReadCloser, events chan<- *docker.APIEvents, stop <-chan struct{}, lastSeen int64) int64 {
+	// Closing the body interrupts reading from it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		body.Close()
+	}()
+
+	dec := json.NewDecoder(body)
+	for {
+		ev := &docker.APIEvents{}
+		if err := dec.Decode(ev); err != nil {
+			return lastSeen
+		}
+		if ev.Time > lastSeen {
+			lastSeen = ev.Time
+		}
+
+		select {
+		case events <- ev:
+		case <-stop:
+			return lastSeen
+		}
+	}
+}
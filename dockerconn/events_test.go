@@ -0,0 +1,113 @@
+package dockerconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	// A server that sends one event on each stream, and then ends it.
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	base := time.Now().Unix() + 100
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			http.NotFound(w, r)
+			return
+		}
+
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		n := len(queries)
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(&docker.APIEvents{
+			ID:     "abc",
+			Status: "die",
+			Time:   base + int64(n),
+		})
+	}))
+	defer server.Close()
+
+	c, err := New(Options{
+		Endpoint: strings.Replace(server.URL, "https://", "tcp://", 1),
+		TLS:      true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	events := make(chan *docker.APIEvents)
+	stop := make(chan struct{})
+	defer close(stop)
+	assert.NoError(t, c.Events(events, stop))
+
+	for _, expected := range []int64{base + 1, base + 2} {
+		select {
+		case ev := <-events:
+			assert.Equal(t, ev.Time, expected)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event")
+		}
+	}
+
+	// The stream is reopened from the last event seen.
+	mu.Lock()
+	assert.Equal(t, queries[:2], []string{"", fmt.Sprintf("since=%d", base+1)})
+	mu.Unlock()
+}
+
+func TestEventsReconnectBeforeEvents(t *testing.T) {
+	t.Parallel()
+
+	// The first stream ends without any events.
+	queries := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			http.NotFound(w, r)
+			return
+		}
+		queries <- r.URL.RawQuery
+		if len(r.URL.RawQuery) > 0 {
+			json.NewEncoder(w).Encode(&docker.APIEvents{ID: "abc", Status: "die", Time: 200})
+		}
+	}))
+	defer server.Close()
+
+	c, err := New(Options{Endpoint: server.URL})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	events := make(chan *docker.APIEvents)
+	stop := make(chan struct{})
+	defer close(stop)
+	before := time.Now().Unix()
+	assert.NoError(t, c.Events(events, stop))
+	after := time.Now().Unix()
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for event")
+	}
+
+	// The stream is reopened from when it was first opened.
+	assert.Equal(t, <-queries, "")
+	since := <-queries
+	assert.True(t, since == fmt.Sprintf("since=%d", before) || since == fmt.Sprintf("since=%d", after),
+		"unexpected query %q", since)
+}
@@ -0,0 +1,61 @@
+// Package exitcode marks errors with the code that a tool should exit with,
+// so that scripts can tell what went wrong.  Each tool documents the codes in
+// its usage message, so they mustn't change.
+package exitcode
+
+import (
+	"fmt"
+)
+
+const (
+	OK         = 0
+	Failure    = 1 // the command failed, without changing anything
+	Usage      = 2 // invalid arguments
+	Config     = 3 // invalid options or config file
+	Connection = 4 // can't connect to Docker
+	Partial    = 5 // the command failed after doing some of what it was asked
+)
+
+// An Error is an error that a tool exits with a particular code for.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// With returns the given error, marked to exit with the given code.
+func With(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Errorf returns a new error that exits with the given code.
+func Errorf(code int, format string, args ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Of returns the code to exit with after the given error.  Errors that
+// aren't marked with a code are failures.
+func Of(err error) int {
+	if err == nil {
+		return OK
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return Failure
+}
+
+// PartialError returns the error for a command that failed after changing
+// the given number of things.  If it changed any, it's a partial success.
+func PartialError(changed int, err error) error {
+	if changed > 0 && Of(err) == Failure {
+		return With(Partial, err)
+	}
+	return err
+}
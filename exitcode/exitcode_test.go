@@ -0,0 +1,32 @@
+package exitcode
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOf(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, Of(nil), OK)
+	assert.Equal(t, Of(errors.New("failed")), Failure)
+	assert.Equal(t, Of(Errorf(Config, "bad config")), Config)
+	assert.Equal(t, Of(With(Connection, errors.New("refused"))), Connection)
+	assert.Nil(t, With(Connection, nil))
+	assert.EqualError(t, Errorf(Config, "bad %s", "config"), "bad config")
+}
+
+func TestPartialError(t *testing.T) {
+	t.Parallel()
+
+	err := errors.New("failed")
+	assert.Equal(t, PartialError(0, err), err)
+	assert.Equal(t, Of(PartialError(1, err)), Partial)
+	assert.Nil(t, PartialError(1, nil))
+
+	// Errors that already have a code keep it.
+	err = Errorf(Connection, "refused")
+	assert.Equal(t, Of(PartialError(1, err)), Connection)
+}